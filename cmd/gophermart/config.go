@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/configs"
+)
+
+// printConfig shows the effective config with secrets redacted, then reports whether it
+// is valid:
+//
+//	gophermart config print [-format yaml|json|toml] [server flags]
+func printConfig(args []string) {
+	flags := flag.NewFlagSet("config print", flag.ExitOnError)
+	format := flags.String("format", "yaml", "Output format: yaml, json or toml")
+	config, err := configs.Load(flags, args)
+	var errValidation *configs.ValidationError
+	if err != nil && !errors.As(err, &errValidation) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if errPrint := configs.Print(os.Stdout, config, *format); errPrint != nil {
+		fmt.Fprintln(os.Stderr, errPrint)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/accrual"
+	"github.com/fortuna91/ya_praktikum_final/internal/breaker"
+	"github.com/fortuna91/ya_praktikum_final/internal/configs"
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/health"
+)
+
+// accrualProbeInterval is how long the result of a request to the accrual system is reused,
+// so frequent readiness probes don't load it.
+const accrualProbeInterval = 15 * time.Second
+
+func registerHealthChecks(db *dbmodule.DBStorage, config configs.ServerConfig) {
+	health.Register("database", true, db.Ping)
+	// a server that migrates on start has written the version itself, so the check only
+	// means something when migrations are run apart from it
+	if !config.Migrate {
+		health.Register("schema", true, func(ctx context.Context) error {
+			version, err := db.GetSchemaVersion(ctx)
+			if err != nil {
+				return err
+			}
+			if version < dbmodule.SchemaVersion {
+				return fmt.Errorf("schema version %d, want %d, run gophermartctl migrate", version, dbmodule.SchemaVersion)
+			}
+			return nil
+		})
+	}
+	health.Register("accrual_worker", true, func(ctx context.Context) error {
+		// a poll may take the whole request timeout, so allow for it before giving up
+		maxSilence := 3*accrual.HeartbeatInterval + accrual.ContextCancelTimeout
+		if last := accrual.Heartbeat(); time.Since(last) > maxSilence {
+			return fmt.Errorf("no heartbeat since %s", last.Format(time.RFC3339))
+		}
+		return nil
+	})
+	// an unreachable accrual system delays accruals but doesn't stop the service, so the
+	// check is reported without making the service unready
+	probe := &accrualProbe{url: config.AccrualSystem, client: &http.Client{Timeout: health.Timeout}}
+	health.Register("accrual_system", false, func(ctx context.Context) error {
+		if err := probe.check(ctx); err != nil {
+			return err
+		}
+		var open []string
+		for _, provider := range accrual.Providers() {
+			if p, ok := provider.(accrual.BreakerProvider); ok && p.BreakerState() != breaker.Closed {
+				open = append(open, provider.Name()+" is "+p.BreakerState().String())
+			}
+		}
+		if open != nil {
+			return fmt.Errorf("circuit breaker: %s", strings.Join(open, ", "))
+		}
+		return nil
+	})
+}
+
+// accrualProbe requests the base URL of the accrual system. Any response below 500 means
+// it is up; the result is kept for accrualProbeInterval.
+type accrualProbe struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+func (p *accrualProbe) check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.checkedAt) < accrualProbeInterval {
+		return p.err
+	}
+	err := p.request(ctx)
+	if ctx.Err() != nil {
+		// the probe was given up, not the accrual system
+		return err
+	}
+	p.err, p.checkedAt = err, time.Now()
+	return err
+}
+
+func (p *accrualProbe) request(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("accrual system is unreachable: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("accrual system response code %d", response.StatusCode)
+	}
+	return nil
+}
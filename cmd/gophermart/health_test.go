@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccrualProbe(t *testing.T) {
+	calls := 0
+	status := http.StatusNotFound
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	probe := &accrualProbe{url: server.URL, client: &http.Client{Timeout: time.Second}}
+
+	// the base URL of the accrual system has no handler, a 404 still means it is up
+	if err := probe.check(context.Background()); err != nil {
+		t.Fatalf("check() = %v", err)
+	}
+	status = http.StatusBadGateway
+	if err := probe.check(context.Background()); err != nil || calls != 1 {
+		t.Errorf("check() = %v after %d calls, want the cached result", err, calls)
+	}
+
+	probe.checkedAt = time.Now().Add(-accrualProbeInterval)
+	if err := probe.check(context.Background()); err == nil || calls != 2 {
+		t.Errorf("check() = %v after %d calls, want the 502", err, calls)
+	}
+
+	server.Close()
+	probe.checkedAt = time.Time{}
+	if err := probe.check(context.Background()); err == nil {
+		t.Error("check() of a stopped server succeeded")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	if err := drain(context.Background(), 10*time.Millisecond); err != nil {
+		t.Errorf("drain() = %v, want nil after the delay", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := drain(ctx, time.Minute); err != context.DeadlineExceeded {
+		t.Errorf("drain() = %v, want the shutdown deadline", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("drain outlived the shutdown deadline")
+	}
+}
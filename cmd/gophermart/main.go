@@ -4,7 +4,6 @@ import (
 	"context"
 	"net/http"
 	"os"
-	"os/signal"
 	"syscall"
 	"time"
 
@@ -12,57 +11,206 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/fortuna91/ya_praktikum_final/internal/accrual"
-	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/breaker"
 	"github.com/fortuna91/ya_praktikum_final/internal/configs"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+	"github.com/fortuna91/ya_praktikum_final/internal/events"
 	"github.com/fortuna91/ya_praktikum_final/internal/handlers"
+	"github.com/fortuna91/ya_praktikum_final/internal/health"
+	lifecyclemodule "github.com/fortuna91/ya_praktikum_final/internal/lifecycle"
+	"github.com/fortuna91/ya_praktikum_final/internal/metrics"
 	"github.com/fortuna91/ya_praktikum_final/internal/middleware"
+	"github.com/fortuna91/ya_praktikum_final/internal/outbox"
+	"github.com/fortuna91/ya_praktikum_final/internal/ratelimit"
+	"github.com/fortuna91/ya_praktikum_final/internal/reconcile"
 	"github.com/fortuna91/ya_praktikum_final/internal/server"
+	"github.com/fortuna91/ya_praktikum_final/internal/tracing"
+	"github.com/fortuna91/ya_praktikum_final/internal/webhook"
 )
 
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	// work outside of requests logs through log.Ctx as well
+	zerolog.DefaultContextLogger = &log.Logger
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		printConfig(os.Args[3:])
+		return
+	}
 	config := configs.SetServerConfig()
+	settings, err := parseRuntimeSettings(config)
+	if err != nil {
+		fatal(err)
+	}
+	settings.apply()
+
+	shutdownTracing, err := tracing.Setup(context.Background(), config.TracingExporter, config.TracingEndpoint,
+		config.TracingSampleRatio)
+	if err != nil {
+		fatal(err)
+	}
 
+	server.BodyLimit = config.BodyLimit
+	server.OrderBodyLimit = config.OrderBodyLimit
+	server.BatchBodyLimit = config.BatchBodyLimit
+	server.AccrualCallbackSecret = config.AccrualCallbackSecret
 	r := server.NewRouter()
-	server := &http.Server{Addr: config.Address, Handler: middleware.Authorization(r)}
+	srv := &http.Server{Addr: config.Address, Handler: r}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGQUIT)
-	go func() {
-		<-sigChan
+	srv.RegisterOnShutdown(handlers.CloseEvents)
 
-		ctx, serverStopCtx := context.WithTimeout(context.Background(), 10*time.Second)
-		err := server.Shutdown(ctx)
-		if err != nil {
-			log.Err(err)
-			panic(err)
-		}
-		serverStopCtx()
-		log.Info().Msg("Server was stopped correctly")
-	}()
+	lifecycle := lifecyclemodule.New(config.ShutdownTimeout)
+	lifecycle.OnStop("readiness", func(context.Context) error {
+		health.SetShuttingDown()
+		return nil
+	})
+	// probes see /readyz failing and take the instance out of rotation meanwhile
+	lifecycle.OnStop("drain", func(ctx context.Context) error {
+		return drain(ctx, config.ShutdownDrainDelay)
+	})
+	// stops accepting requests and waits for the ones in progress, uploads included
+	lifecycle.OnStop("HTTP server", srv.Shutdown)
 
 	handlers.HashKey = config.HashKey
 	handlers.ContextCancelTimeout = config.ContextCancel
 	accrual.ContextCancelTimeout = config.ContextCancel
-	accrual.AccrualSystemAddress = config.AccrualSystem
-	auth.TokenDuration = config.TokenDuration
+	accrual.AccrualChannelPool = config.AccrualChannelPool
+	accrual.QueueCh = make(chan entity.Order, config.AccrualChannelPool)
+	accrual.PushMode = config.AccrualCallbackSecret != ""
+	accrual.ReconcileInterval = config.AccrualReconcile
+	accrual.ReconcileAfter = config.AccrualReconcileAfter
+	accrual.MaxAttempts = config.AccrualMaxAttempts
+	accrual.BackoffBase = config.AccrualBackoffBase
+	accrual.BackoffMax = config.AccrualBackoffMax
+	providers, err := accrual.ParseProviders(config.AccrualProviders)
+	if err != nil {
+		fatal(err)
+	}
+	defaultProvider, err := accrual.NewHTTPProvider(accrual.ProviderConfig{
+		Name:          accrual.DefaultProviderName,
+		Address:       config.AccrualSystem,
+		Timeout:       config.AccrualTimeout.String(),
+		MaxIdleConns:  config.AccrualMaxIdleConns,
+		BreakerErrors: config.AccrualBreakerErrors,
+		BreakerOpen:   config.AccrualBreakerOpen.String(),
+	})
+	if err != nil {
+		fatal(err)
+	}
+	if err = accrual.SetProviders(defaultProvider, providers); err != nil {
+		fatal(err)
+	}
+	for _, provider := range accrual.Providers() {
+		if httpProvider, ok := provider.(*accrual.HTTPProvider); ok {
+			name := provider.Name()
+			metrics.AccrualBreakerState.WithLabelValues(name).Set(float64(httpProvider.BreakerState()))
+			httpProvider.Breaker().OnStateChange(func(from breaker.State, to breaker.State) {
+				log.Warn().Msgf("Accrual provider %s circuit breaker: %s -> %s", name, from, to)
+				metrics.AccrualBreakerState.WithLabelValues(name).Set(float64(to))
+			})
+		}
+	}
+	middleware.DecompressLimit = config.DecompressLimit
+	middleware.CompressMinSize = config.CompressMinSize
+	handlers.PasswordMinLength = config.PasswordMinLength
+	handlers.BatchMaxOrders = config.BatchMaxOrders
+	handlers.EventsHeartbeat = config.EventsHeartbeat
+	events.Default = events.NewBroker(config.EventsHistorySize)
 
+	handlers.Migrate = config.Migrate
 	if err := handlers.PrepareDB(config.DB); err != nil {
-		log.Err(err)
-		panic(err)
+		fatal(err)
+	}
+	lifecycle.OnClose("database", func(context.Context) error {
+		handlers.GetDB().Close()
+		return nil
+	})
+	lifecycle.OnClose("tracing", shutdownTracing)
+
+	if config.RateLimitStore == "postgres" {
+		ratelimit.Default = ratelimit.NewPostgres(handlers.GetDB())
 	}
 
+	registerHealthChecks(handlers.GetDB(), config)
+	metrics.WatchDB(handlers.GetDB().DB())
+	metrics.WatchAccrualQueue(func() int { return len(accrual.QueueCh) })
+
+	if config.EventsPGNotify {
+		events.Default.SetRemote(events.PostgresRemote(handlers.GetDB()))
+		lifecycle.Go("events listener", func(ctx context.Context) {
+			events.ListenPostgres(ctx, config.DB, events.Default)
+		})
+	}
+
+	webhook.PollInterval = config.WebhookPollInterval
+	webhook.MaxAttempts = config.WebhookMaxAttempts
+	webhook.BackoffBase = config.WebhookBackoffBase
+	webhook.Timeout = config.WebhookTimeout
+	lifecycle.Go("webhook sender", func(ctx context.Context) {
+		webhook.Run(ctx, handlers.GetDB())
+	})
+
+	outbox.PollInterval = config.OutboxPollInterval
+	outbox.BatchSize = config.OutboxBatchSize
+	publishers := outbox.Multi{outbox.DefaultBus}
+	if config.OutboxFile != "" {
+		filePublisher, err := outbox.NewFilePublisher(config.OutboxFile)
+		if err != nil {
+			fatal(err)
+		}
+		publishers = append(publishers, filePublisher)
+		lifecycle.OnClose("outbox file", func(context.Context) error {
+			return filePublisher.Close()
+		})
+	}
+	lifecycle.Go("outbox relay", func(ctx context.Context) {
+		outbox.Run(ctx, handlers.GetDB(), publishers)
+	})
+
 	// run accrual system
+	lifecycle.Go("accrual workers", func(ctx context.Context) {
+		accrual.RunWorkers(ctx, handlers.GetDB(), config.AccrualWorkers)
+	})
+	lifecycle.Go("accrual reconciler", func(ctx context.Context) {
+		accrual.Reconcile(ctx, handlers.GetDB())
+	})
+
+	reconcile.Interval = config.ReconcileInterval
+	reconcile.Window = config.ReconcileWindow
+	reconcile.Correct = config.ReconcileCorrect
+	reconcile.DryRun = config.ReconcileDryRun
+	lifecycle.Go("balance reconciliation", func(ctx context.Context) {
+		reconcile.Run(ctx, handlers.GetDB())
+	})
+
+	lifecycle.Go("config reload", func(ctx context.Context) {
+		watchConfig(ctx, config)
+	})
+
+	log.Info().Msgf("Start server on %s", config.Address)
 	go func() {
-		accrual.UpdateOrders(handlers.GetDB())
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lifecycle.Fail(err)
+		}
 	}()
+	os.Exit(lifecycle.Wait(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT))
+}
 
-	log.Info().Msgf("Start server on %s", config.Address)
-	err := server.ListenAndServe()
-	if err != nil && err != http.ErrServerClosed {
-		log.Err(err)
+// drain waits for delay while requests are still served, or until the shutdown deadline.
+func drain(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
+
+func fatal(err error) {
+	log.Fatal().Msgf("Couldn't start: %v", err)
+}
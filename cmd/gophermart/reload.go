@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/accrual"
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/configs"
+	"github.com/fortuna91/ya_praktikum_final/internal/ratelimit"
+)
+
+// runtimeSettings are the settings that can be changed without a restart, except the
+// accrual workers. All of them are parsed before any is applied, so a reload takes effect
+// completely or not at all.
+type runtimeSettings struct {
+	level         zerolog.Level
+	tokenDuration time.Duration
+	rateLimits    map[string]ratelimit.Limit
+}
+
+func parseRuntimeSettings(config configs.ServerConfig) (runtimeSettings, error) {
+	level, err := zerolog.ParseLevel(config.LogLevel)
+	if err != nil {
+		return runtimeSettings{}, err
+	}
+	rateLimits, err := ratelimit.ParseLimits(config.RateLimits)
+	if err != nil {
+		return runtimeSettings{}, err
+	}
+	return runtimeSettings{level: level, tokenDuration: config.TokenDuration, rateLimits: rateLimits}, nil
+}
+
+// apply sets all the settings, it can't fail halfway.
+func (s runtimeSettings) apply() {
+	zerolog.SetGlobalLevel(s.level)
+	auth.SetTokenDuration(s.tokenDuration)
+	ratelimit.SetLimits(s.rateLimits)
+}
+
+// watchConfig reloads the config on SIGHUP and when the config file changes, until ctx
+// is done.
+func watchConfig(ctx context.Context, config configs.ServerConfig) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if config.ConfigFile != "" && config.ConfigWatchInterval > 0 {
+		ticker := time.NewTicker(config.ConfigWatchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	stamp := fileStamp(config.ConfigFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info().Msg("Got SIGHUP, reloading config")
+		case <-tick:
+			next := fileStamp(config.ConfigFile)
+			if next == stamp {
+				continue
+			}
+			stamp = next
+			log.Info().Msgf("Config file %s has changed, reloading config", config.ConfigFile)
+		}
+		config = reloadConfig(config)
+	}
+}
+
+// fileStamp tells file versions apart, "" when there is no file.
+func fileStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return info.ModTime().String() + "/" + strconv.FormatInt(info.Size(), 10)
+}
+
+// reloadConfig loads the config again and applies the reloadable settings of it. An invalid
+// config is rejected as a whole and the running one stays. It returns the running config.
+func reloadConfig(current configs.ServerConfig) configs.ServerConfig {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	next, err := configs.Load(flags, os.Args[1:])
+	if err != nil {
+		log.Error().Msgf("Config reload rejected, keeping the running config: %v", err)
+		return current
+	}
+
+	var applied []string
+	for _, change := range configs.Diff(current, next) {
+		if change.Reloadable {
+			applied = append(applied, change.String())
+		} else {
+			log.Warn().Msgf("Config reload: %s needs a restart", change)
+		}
+	}
+	if len(applied) == 0 {
+		log.Info().Msg("Config reloaded, no changes to apply")
+		return current
+	}
+
+	running := current
+	running.LogLevel = next.LogLevel
+	running.TokenDuration = next.TokenDuration
+	running.RateLimits = next.RateLimits
+	running.AccrualWorkers = next.AccrualWorkers
+	settings, err := parseRuntimeSettings(running)
+	if err != nil {
+		log.Error().Msgf("Config reload rejected, keeping the running config: %v", err)
+		return current
+	}
+	settings.apply()
+	if running.AccrualWorkers != current.AccrualWorkers {
+		accrual.SetWorkers(running.AccrualWorkers)
+	}
+	log.Info().Msgf("Config reloaded: %s", strings.Join(applied, ", "))
+	return running
+}
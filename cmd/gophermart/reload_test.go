@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/configs"
+	"github.com/fortuna91/ya_praktikum_final/internal/ratelimit"
+)
+
+func TestRuntimeSettingsApplyAllOrNothing(t *testing.T) {
+	level, duration := zerolog.GlobalLevel(), auth.TokenDuration()
+	defer func() {
+		zerolog.SetGlobalLevel(level)
+		auth.SetTokenDuration(duration)
+	}()
+
+	running := configs.ServerConfig{LogLevel: "info", TokenDuration: time.Hour, RateLimits: "orders=60/1m"}
+	settings, err := parseRuntimeSettings(running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.apply()
+
+	for _, next := range []configs.ServerConfig{
+		{LogLevel: "loud", TokenDuration: time.Minute, RateLimits: "orders=5/1m"},
+		{LogLevel: "warn", TokenDuration: time.Minute, RateLimits: "orders=many"},
+	} {
+		if _, err = parseRuntimeSettings(next); err == nil {
+			t.Errorf("parseRuntimeSettings(%+v) accepted an invalid config", next)
+		}
+	}
+	if zerolog.GlobalLevel() != zerolog.InfoLevel || auth.TokenDuration() != time.Hour {
+		t.Errorf("settings changed by a rejected config: %s, %s", zerolog.GlobalLevel(), auth.TokenDuration())
+	}
+	if limit, ok := ratelimit.LimitFor("orders"); !ok || limit.Requests != 60 {
+		t.Errorf("orders limit = %+v, want 60 requests", limit)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/configs"
+	"github.com/fortuna91/ya_praktikum_final/internal/handlers"
+	"github.com/fortuna91/ya_praktikum_final/internal/outbox"
+)
+
+// replay publishes outbox messages again, to the JSONL file or to stdout:
+//
+//	gophermart replay [-config <file>] [-d <dsn>] [-from <id>] [-user <id>] [-file <path>]
+//
+// The database URI and timeouts are read like the server reads them. The tables are left
+// as they are, a replay never migrates them.
+func replay(args []string) {
+	config, err := configs.LoadEnvironment(args)
+	if err != nil {
+		log.Fatal().Msgf("Couldn't read config: %v", err)
+	}
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.String("config", config.ConfigFile, "Config file, YAML, JSON or TOML by extension")
+	dsn := flags.String("d", config.DB, "Database URI")
+	fromID := flags.Int64("from", 0, "Replay messages after this ID")
+	userID := flags.Int64("user", 0, "Replay messages of this user only")
+	file := flags.String("file", "", "JSONL file to append messages to, stdout by default")
+	_ = flags.Parse(args)
+
+	handlers.ContextCancelTimeout = config.ContextCancel
+	handlers.Migrate = false
+	if err = handlers.PrepareDB(*dsn); err != nil {
+		log.Fatal().Msgf("Couldn't connect to DB: %v", err)
+	}
+	var publisher *outbox.FilePublisher
+	if *file == "" {
+		publisher = outbox.NewWriterPublisher(os.Stdout)
+	} else {
+		if publisher, err = outbox.NewFilePublisher(*file); err != nil {
+			log.Fatal().Msgf("Couldn't open %s: %v", *file, err)
+		}
+		defer publisher.Close()
+	}
+
+	count, err := outbox.Replay(context.Background(), handlers.GetDB(), publisher, *fromID, *userID)
+	if err != nil {
+		// the publisher syncs every message, so nothing is lost by exiting without Close
+		log.Fatal().Msgf("Replay stopped after %d messages: %v", count, err)
+	}
+	log.Info().Msgf("Replayed %d messages", count)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+func newFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+func users(ctx context.Context, db *dbmodule.DBStorage, out *output, args []string) error {
+	flags := newFlags("users")
+	limit := flags.Int("limit", 100, "Max users shown")
+	afterID := flags.Int64("after", 0, "Show users after this ID")
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	search := ""
+	switch {
+	case len(args) == 1 && args[0] == "list":
+	case len(args) == 2 && args[0] == "search":
+		search = args[1]
+	default:
+		return errUsage
+	}
+
+	found, err := db.SearchUsers(ctx, search, *afterID, *limit)
+	if err != nil {
+		return err
+	}
+	return printUsers(out, found)
+}
+
+var userHeader = []string{"ID", "LOGIN", "ADMIN", "CURRENT", "WITHDRAWN", "ORDERS"}
+
+func userRow(user entity.UserSummary) []string {
+	return []string{strconv.FormatInt(user.ID, 10), user.Login, strconv.FormatBool(user.IsAdmin),
+		formatPoints(user.Current), formatPoints(user.Withdrawn), strconv.Itoa(user.Orders)}
+}
+
+func printUsers(out *output, users []entity.UserSummary) error {
+	if users == nil {
+		users = []entity.UserSummary{}
+	}
+	rows := make([][]string, 0, len(users))
+	for _, user := range users {
+		rows = append(rows, userRow(user))
+	}
+	return out.print(users, userHeader, rows)
+}
+
+func balance(ctx context.Context, db *dbmodule.DBStorage, out *output, args []string) error {
+	flags := newFlags("balance")
+	limit := flags.Int("limit", 50, "Max history entries shown")
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errUsage
+	}
+	user, err := getUser(ctx, db, args[0])
+	if err != nil {
+		return err
+	}
+	current := db.GetBalance(ctx, user.ID)
+	if current == nil {
+		return fmt.Errorf("there is no balance for user %s", user.Login)
+	}
+	history, err := db.GetBalanceHistory(ctx, user.ID, *limit)
+	if err != nil {
+		return err
+	}
+	if history == nil {
+		history = []entity.BalanceEntry{}
+	}
+
+	if !out.json {
+		fmt.Fprintf(out.w, "User %s: current %s, withdrawn %s\n\n", user.Login, formatPoints(current.Current),
+			formatPoints(current.Withdrawn))
+	}
+	rows := make([][]string, 0, len(history))
+	for _, entry := range history {
+		rows = append(rows, []string{formatTime(entry.At), entry.Kind, entry.Reference, formatPoints(entry.Amount)})
+	}
+	return out.print(struct {
+		Login     string                `json:"login"`
+		Current   float32               `json:"current"`
+		Withdrawn float32               `json:"withdrawn"`
+		History   []entity.BalanceEntry `json:"history"`
+	}{user.Login, current.Current, current.Withdrawn, history}, []string{"AT", "KIND", "REFERENCE", "AMOUNT"}, rows)
+}
+
+// requeue takes orders out of the dead-letter status. The server polls them again when
+// its reconciliation finds them unfinished.
+func requeue(ctx context.Context, db *dbmodule.DBStorage, out *output, args []string) error {
+	flags := newFlags("requeue")
+	failed := flags.Bool("failed", false, "Requeue all dead-lettered orders")
+	limit := flags.Int("limit", 1000, "Max dead-lettered orders requeued with -failed")
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if *failed == (len(args) > 0) {
+		return errUsage
+	}
+	numbers := args
+	if *failed {
+		orders, err := db.GetFailedOrders(ctx, *limit)
+		if err != nil {
+			return err
+		}
+		for _, order := range orders {
+			numbers = append(numbers, order.Number)
+		}
+	}
+
+	requeued := []string{}
+	failedNumbers := []string{}
+	for _, number := range numbers {
+		if _, err = db.RequeueOrder(ctx, number); err != nil {
+			fmt.Fprintf(os.Stderr, "gophermartctl: order %s: %v\n", number, err)
+			failedNumbers = append(failedNumbers, number)
+			continue
+		}
+		requeued = append(requeued, number)
+	}
+	result := map[string][]string{"requeued": requeued, "failed": failedNumbers}
+	if len(failedNumbers) == 0 {
+		return out.message(result, "Requeued %d orders", len(requeued))
+	}
+	err = out.message(result, "Requeued %d orders: %s\nFailed %d orders: %s", len(requeued),
+		strings.Join(requeued, " "), len(failedNumbers), strings.Join(failedNumbers, " "))
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("couldn't requeue %d of %d orders", len(failedNumbers), len(numbers))
+}
+
+// migrate creates and upgrades the tables, like the server does on start.
+func migrate(ctx context.Context, db *dbmodule.DBStorage, out *output, args []string) (err error) {
+	if len(args) != 0 {
+		return errUsage
+	}
+	from, err := db.GetSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// table creation panics on errors
+		if r := recover(); r != nil {
+			err = fmt.Errorf("migration failed: %v", r)
+		}
+	}()
+	db.Create(ctx)
+	to, err := db.GetSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	return out.message(map[string]int{"from": from, "to": to}, "Schema version %d -> %d", from, to)
+}
+
+func admin(ctx context.Context, db *dbmodule.DBStorage, out *output, args []string) error {
+	flags := newFlags("admin")
+	passwordFile := flags.String("password-file", "", "File with the password, stdin by default")
+	hashKey := flags.String("k", serverConfig.HashKey, "Hash key for passwords, the one of the server")
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return errUsage
+	}
+	login := args[1]
+
+	switch args[0] {
+	case "grant", "revoke":
+		if err = db.SetAdmin(ctx, login, args[0] == "grant"); err != nil {
+			return err
+		}
+		return out.message(map[string]interface{}{"login": login, "is_admin": args[0] == "grant"},
+			"Admin access of %s: %s", login, args[0])
+	case "create":
+	default:
+		return errUsage
+	}
+
+	if *hashKey == "" {
+		return errors.New("hash key is not set, use -k or HASH_KEY")
+	}
+	password, err := readPassword(*passwordFile)
+	if err != nil {
+		return err
+	}
+	if len(password) < serverConfig.PasswordMinLength {
+		return fmt.Errorf("password must be at least %d characters long", serverConfig.PasswordMinLength)
+	}
+	id, err := db.AddAdmin(ctx, login, auth.CalcHash(*hashKey, password))
+	if err != nil {
+		return err
+	}
+	return out.message(map[string]interface{}{"id": id, "login": login}, "Created admin %s with ID %d", login, id)
+}
+
+// readPassword reads the first line of the file, or of stdin when path is empty, so the
+// password doesn't show up in the process list.
+func readPassword(path string) (string, error) {
+	in := os.Stdin
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		in = file
+	} else {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("couldn't read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func adjust(ctx context.Context, db *dbmodule.DBStorage, out *output, args []string) error {
+	args, err := parseArgs(newFlags("adjust"), args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errUsage
+	}
+	amount, err := strconv.ParseFloat(args[1], 32)
+	if err != nil || amount == 0 {
+		return fmt.Errorf("amount %q must be a non-zero number", args[1])
+	}
+	reason := strings.Join(args[2:], " ")
+	user, err := getUser(ctx, db, args[0])
+	if err != nil {
+		return err
+	}
+	adjustment, err := db.AdjustBalance(ctx, user.ID, float32(amount), reason)
+	if err != nil {
+		return err
+	}
+	return out.message(adjustment, "Adjusted balance of %s by %s, adjustment %d", user.Login,
+		formatPoints(adjustment.Amount), adjustment.ID)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+const exportPageSize = 500
+
+type exportedOrder struct {
+	User string `json:"user"`
+	entity.Order
+	Partner  string `json:"partner,omitempty"`
+	Provider string `json:"provider,omitempty"`
+}
+
+type exportedWithdrawal struct {
+	User string `json:"user"`
+	entity.Withdrawals
+}
+
+type exportedAdjustment struct {
+	User string `json:"user"`
+	entity.BalanceAdjustment
+}
+
+// export prints data of one user or of all users.
+func export(ctx context.Context, db *dbmodule.DBStorage, out *output, args []string) error {
+	flags := newFlags("export")
+	login := flags.String("user", "", "Export data of this user only")
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errUsage
+	}
+	what := args[0]
+	if what != "users" && what != "orders" && what != "withdrawals" && what != "adjustments" {
+		return errUsage
+	}
+
+	var userID int64
+	if *login != "" {
+		user, err := getUser(ctx, db, *login)
+		if err != nil {
+			return err
+		}
+		userID = user.ID
+	}
+
+	switch what {
+	case "users":
+		return exportUsers(ctx, db, out, userID)
+	case "orders":
+		list := out.list([]string{"USER", "NUMBER", "STATUS", "ACCRUAL", "UPLOADED", "PARTNER", "PROVIDER"})
+		err = db.ExportOrders(ctx, userID, func(login string, order entity.Order) error {
+			return list.add(exportedOrder{User: login, Order: order, Partner: order.Partner, Provider: order.Provider},
+				[]string{login, order.ID, order.Status, formatPoints(order.Accrual), formatTime(order.UploadedAt),
+					order.Partner, order.Provider})
+		})
+		return closeList(list, err)
+	case "withdrawals":
+		list := out.list([]string{"USER", "ORDER", "SUM", "PROCESSED"})
+		err = db.ExportWithdrawals(ctx, userID, func(login string, withdrawal entity.Withdrawals) error {
+			return list.add(exportedWithdrawal{User: login, Withdrawals: withdrawal},
+				[]string{login, withdrawal.OrderID, formatPoints(withdrawal.Sum), formatTime(withdrawal.ProcessedAt)})
+		})
+		return closeList(list, err)
+	default:
+		list := out.list([]string{"USER", "ID", "ORDER", "AMOUNT", "REASON", "CREATED"})
+		err = db.ExportAdjustments(ctx, userID, func(login string, adjustment entity.BalanceAdjustment) error {
+			return list.add(exportedAdjustment{User: login, BalanceAdjustment: adjustment},
+				[]string{login, strconv.FormatInt(adjustment.ID, 10), adjustment.OrderID, formatPoints(adjustment.Amount),
+					adjustment.Reason, adjustment.CreatedAt.Format(time.RFC3339)})
+		})
+		return closeList(list, err)
+	}
+}
+
+// exportUsers prints the user with userID, or all users page by page when it is 0.
+func exportUsers(ctx context.Context, db *dbmodule.DBStorage, out *output, userID int64) error {
+	list := out.list(userHeader)
+	if userID != 0 {
+		user, err := db.GetUserSummary(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if err = list.add(user, userRow(*user)); err != nil {
+			return err
+		}
+		return list.close()
+	}
+
+	var afterID int64
+	for {
+		page, err := db.SearchUsers(ctx, "", afterID, exportPageSize)
+		if err != nil {
+			return closeList(list, err)
+		}
+		for _, user := range page {
+			if err = list.add(user, userRow(user)); err != nil {
+				return err
+			}
+		}
+		if len(page) < exportPageSize {
+			return list.close()
+		}
+		afterID = page[len(page)-1].ID
+	}
+}
+
+// closeList ends the list printed so far, so the output stays valid when the export fails
+// midway, and returns the error.
+func closeList(list *list, err error) error {
+	if errClose := list.close(); err == nil {
+		err = errClose
+	}
+	return err
+}
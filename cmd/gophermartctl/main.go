@@ -0,0 +1,145 @@
+// gophermartctl is the admin tool of gophermart. It works with the database directly,
+// through the same storage code as the server:
+//
+//	gophermartctl [-config <file>] [-d <dsn>] [-format table|json] <command> [arguments]
+//
+// The database URI and the hash key are read like the server reads them: from the config
+// file, the environment and *_FILE secrets.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/configs"
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, db *dbmodule.DBStorage, out *output, args []string) error
+}
+
+var commands = map[string]command{
+	"users":   {"users list|search <text> [-limit n] [-after id]", users},
+	"balance": {"balance <login> [-limit n]", balance},
+	"requeue": {"requeue <order>... | requeue -failed [-limit n]", requeue},
+	"migrate": {"migrate", migrate},
+	"admin":   {"admin create <login> [-password-file path] | admin grant|revoke <login>", admin},
+	"adjust":  {"adjust <login> <amount> <reason>", adjust},
+	"export":  {"export users|orders|withdrawals|adjustments [-user login]", export},
+}
+
+var commandOrder = []string{"users", "balance", "requeue", "adjust", "admin", "migrate", "export"}
+
+// errUsage makes main print the usage of the command.
+var errUsage = errors.New("wrong arguments")
+
+// serverConfig holds the settings shared with the server, without its validation: the
+// tool needs only a few of them.
+var serverConfig configs.ServerConfig
+
+func main() {
+	var err error
+	if serverConfig, err = configs.LoadEnvironment(os.Args[1:]); err != nil {
+		fail(err)
+	}
+	flags := flag.NewFlagSet("gophermartctl", flag.ExitOnError)
+	flags.String("config", serverConfig.ConfigFile, "Config file of the server, YAML, JSON or TOML by extension")
+	dsn := flags.String("d", serverConfig.DB, "Database URI")
+	format := flags.String("format", "table", "Output format: table or json")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gophermartctl [-config <file>] [-d <dsn>] [-format table|json] <command> [arguments]\n\nCommands:")
+		for _, name := range commandOrder {
+			fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+		}
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(os.Args[1:])
+	args := flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "gophermartctl: unknown command %q\n", args[0])
+		flags.Usage()
+		os.Exit(2)
+	}
+	out, err := newOutput(os.Stdout, *format)
+	if err != nil {
+		fail(err)
+	}
+
+	// the storage logs every change, operators need only the problems
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	db, err := dbmodule.New(*dsn)
+	if err != nil {
+		fail(err)
+	}
+	err = cmd.run(ctx, db, out, args[1:])
+	db.Close()
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(os.Stderr, "Usage: gophermartctl "+cmd.usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "gophermartctl:", err)
+	os.Exit(1)
+}
+
+// getUser finds the user by login.
+func getUser(ctx context.Context, db *dbmodule.DBStorage, login string) (*entity.User, error) {
+	user := db.GetUser(ctx, login)
+	if user == nil {
+		return nil, fmt.Errorf("user %s: %w", login, dbmodule.ErrUserNotFound)
+	}
+	return user, nil
+}
+
+// parseArgs parses flags placed anywhere among the arguments and returns the rest.
+// Negative numbers are arguments, not flags.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if len(args) > 0 && isNegativeNumber(args[0]) {
+			positional = append(positional, args[0])
+			args = args[1:]
+			continue
+		}
+		if err := flags.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func isNegativeNumber(arg string) bool {
+	_, err := strconv.ParseFloat(arg, 64)
+	return err == nil && strings.HasPrefix(arg, "-")
+}
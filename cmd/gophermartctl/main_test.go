@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		positional []string
+		limit      int
+		x          bool
+	}{
+		{"adjust with a negative amount", []string{"gopher", "-5", "reason", "-x"}, []string{"gopher", "-5", "reason"}, 10, true},
+		{"negative fraction", []string{"-x", "gopher", "-0.5", "reason"}, []string{"gopher", "-0.5", "reason"}, 10, true},
+		{"flag before the command", []string{"-limit", "5", "list"}, []string{"list"}, 5, false},
+		{"flag after the command", []string{"search", "go", "-limit=7"}, []string{"search", "go"}, 7, false},
+		{"no arguments", nil, nil, 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := newFlags("test")
+			limit := flags.Int("limit", 10, "")
+			x := flags.Bool("x", false, "")
+			positional, err := parseArgs(flags, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(positional, tt.positional) {
+				t.Errorf("positional = %q, want %q", positional, tt.positional)
+			}
+			if *limit != tt.limit || *x != tt.x {
+				t.Errorf("-limit %d -x %t, want -limit %d -x %t", *limit, *x, tt.limit, tt.x)
+			}
+		})
+	}
+}
+
+func TestParseArgsUnknownFlag(t *testing.T) {
+	flags := newFlags("test")
+	flags.SetOutput(io.Discard)
+	if _, err := parseArgs(flags, []string{"list", "-unknown"}); !errors.Is(err, errUsage) {
+		t.Errorf("err = %v, want errUsage", err)
+	}
+}
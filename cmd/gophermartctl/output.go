@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// output prints results as an aligned table for people or as JSON for scripts.
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+func newOutput(w io.Writer, format string) (*output, error) {
+	switch format {
+	case "table":
+		return &output{w: w}, nil
+	case "json":
+		return &output{w: w, json: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q, want table or json", format)
+	}
+}
+
+// print writes v as JSON, or header and rows as a table.
+func (o *output) print(v interface{}, header []string, rows [][]string) error {
+	if o.json {
+		encoder := json.NewEncoder(o.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	tw := tabwriter.NewWriter(o.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// list prints values one by one, so long lists don't have to fit in memory: JSON output is
+// an array written as values come, the table is flushed every listFlushRows rows and its
+// columns are aligned within these blocks.
+type list struct {
+	o      *output
+	header []string
+	tw     *tabwriter.Writer
+	rows   int
+}
+
+const listFlushRows = 500
+
+func (o *output) list(header []string) *list {
+	return &list{o: o, header: header}
+}
+
+// add prints v as an array element, or row as a table row.
+func (l *list) add(v interface{}, row []string) error {
+	l.rows++
+	if l.o.json {
+		data, err := json.MarshalIndent(v, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		separator := ",\n  "
+		if l.rows == 1 {
+			separator = "[\n  "
+		}
+		_, err = io.WriteString(l.o.w, separator+string(data))
+		return err
+	}
+	if l.tw == nil {
+		l.tw = tabwriter.NewWriter(l.o.w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(l.tw, strings.Join(l.header, "\t"))
+	}
+	fmt.Fprintln(l.tw, strings.Join(row, "\t"))
+	if l.rows%listFlushRows == 0 {
+		return l.tw.Flush()
+	}
+	return nil
+}
+
+// close ends the list. Empty lists print as in print.
+func (l *list) close() error {
+	if l.o.json {
+		end := "\n]\n"
+		if l.rows == 0 {
+			end = "[]\n"
+		}
+		_, err := io.WriteString(l.o.w, end)
+		return err
+	}
+	if l.tw == nil {
+		return l.o.print(nil, l.header, nil)
+	}
+	return l.tw.Flush()
+}
+
+// message writes a line for people; JSON output gets v instead.
+func (o *output) message(v interface{}, format string, args ...interface{}) error {
+	if o.json {
+		return o.print(v, nil, nil)
+	}
+	_, err := fmt.Fprintf(o.w, format+"\n", args...)
+	return err
+}
+
+func formatPoints(points float32) string {
+	return fmt.Sprintf("%.2f", points)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
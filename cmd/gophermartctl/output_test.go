@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+var (
+	points = []point{{"a", 1}, {"long name", 22}}
+	header = []string{"NAME", "VALUE"}
+	rows   = [][]string{{"a", "1"}, {"long name", "22"}}
+)
+
+const pointsTable = "NAME       VALUE\n" +
+	"a          1\n" +
+	"long name  22\n"
+
+func TestOutputPrint(t *testing.T) {
+	var buf bytes.Buffer
+	out, err := newOutput(&buf, "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = out.print(points, header, rows); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != pointsTable {
+		t.Errorf("table output:\n%s\nwant:\n%s", buf.String(), pointsTable)
+	}
+
+	buf.Reset()
+	if out, err = newOutput(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.print(points, header, rows); err != nil {
+		t.Fatal(err)
+	}
+	var got []point
+	if err = json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("JSON output %q: %v", buf.String(), err)
+	}
+	if !reflect.DeepEqual(got, points) {
+		t.Errorf("JSON output = %+v, want %+v", got, points)
+	}
+}
+
+func TestOutputUnknownFormat(t *testing.T) {
+	if _, err := newOutput(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("newOutput accepted format xml")
+	}
+}
+
+// A list prints the same as print, whatever the number of values.
+func TestOutputList(t *testing.T) {
+	for _, format := range []string{"table", "json"} {
+		for n := 0; n <= len(points); n++ {
+			var printed, listed bytes.Buffer
+			out, _ := newOutput(&printed, format)
+			if err := out.print(points[:n], header, rows[:n]); err != nil {
+				t.Fatal(err)
+			}
+
+			out, _ = newOutput(&listed, format)
+			list := out.list(header)
+			for i := 0; i < n; i++ {
+				if err := list.add(points[i], rows[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := list.close(); err != nil {
+				t.Fatal(err)
+			}
+			if listed.String() != printed.String() {
+				t.Errorf("%s list of %d values:\n%s\nwant:\n%s", format, n, listed.String(), printed.String())
+			}
+		}
+	}
+}
+
+func TestOutputMessage(t *testing.T) {
+	var buf bytes.Buffer
+	out, _ := newOutput(&buf, "table")
+	if err := out.message(map[string]int{"n": 2}, "Requeued %d orders", 2); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "Requeued 2 orders\n" {
+		t.Errorf("table message = %q", buf.String())
+	}
+
+	buf.Reset()
+	out, _ = newOutput(&buf, "json")
+	if err := out.message(map[string]int{"n": 2}, "Requeued %d orders", 2); err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(buf.String()) != "{\n  \"n\": 2\n}" {
+		t.Errorf("JSON message = %q", buf.String())
+	}
+}
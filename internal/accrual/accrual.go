@@ -2,18 +2,22 @@ package accrual
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"net/http"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
-	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/backoff"
 	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
 	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+	"github.com/fortuna91/ya_praktikum_final/internal/events"
+	"github.com/fortuna91/ya_praktikum_final/internal/metrics"
+	"github.com/fortuna91/ya_praktikum_final/internal/tracing"
 )
 
 const (
@@ -26,86 +30,311 @@ const (
 var ContextCancelTimeout time.Duration
 var AccrualChannelPool int
 var QueueCh = make(chan entity.Order, AccrualChannelPool)
-var AccrualSystemAddress string
-var retryAfter = 0
 
-func sendRequest(client *http.Client, request *http.Request) *http.Response {
-	request.Header.Set("Content-Length", "0")
-	response, err := client.Do(request)
-	if err != nil {
-		log.Err(err)
-		return nil
-	}
-	return response
-}
-
-func getAccrual(accrualSystemAddress string, orderID string) (*entity.Order, int) {
-	client := http.Client{}
-	request, _ := http.NewRequest(http.MethodGet, accrualSystemAddress+"/api/orders/"+orderID, nil)
-	response := sendRequest(&client, request)
-	if response == nil {
-		log.Error().Msg("Error in getting accrual")
-		return nil, 0
-	}
-	if response.StatusCode == http.StatusTooManyRequests {
-		retryAfter := response.Header.Get("Retry-After")
-		retryAfterInt, _ := strconv.Atoi(retryAfter)
-		return nil, retryAfterInt
-	} else if response.StatusCode == http.StatusNoContent {
-		log.Warn().Msgf("No Content. Response code %d", response.StatusCode)
-		return nil, -1
-	} else if response.StatusCode != http.StatusOK {
-		log.Error().Msgf("Error in getting accrual. Response code %d", response.StatusCode)
-		return nil, 0
-	}
-	orderResponse := entity.Order{}
-	defer response.Body.Close()
-	respBody := body.GetBody(response.Body)
-	if errJSON := json.Unmarshal(*respBody, &orderResponse); errJSON != nil {
-		log.Error().Msg(errJSON.Error())
-		return nil, 0
-	}
-	return &orderResponse, 0
-}
-
-func updateOrder(db *dbmodule.DBStorage, accrualSystemAddress string, orderID string, userID int64) (*entity.Order, int) {
+// MaxAttempts is the retry budget of an order: after that many failed polls in a row the
+// order gets the dead-letter status FAILED.
+var MaxAttempts = 10
+var BackoffBase = 5 * time.Second
+var BackoffMax = 30 * time.Minute
+
+// PendingDelay is how soon an order the accrual system is still processing is polled again.
+var PendingDelay = time.Second
+
+// ErrNotRegistered is returned for orders the accrual system doesn't know yet. They are
+// polled again after BackoffBase like pending orders, without counting an attempt, because
+// the accrual system registers orders on its own schedule.
+var ErrNotRegistered = errors.New("order is not registered in the accrual system")
+
+// PushMode is set when the accrual system pushes results to the callback endpoint, then
+// orders are polled only by Reconcile.
+var PushMode = false
+var ReconcileInterval = time.Minute
+var ReconcileAfter = 5 * time.Minute
+var ReconcileBatchSize = 100
+
+// HeartbeatInterval is how often the idle worker reports it is alive.
+var HeartbeatInterval = 5 * time.Second
+var heartbeat int64
+
+// queued holds IDs of orders in QueueCh, so an order is never queued twice.
+var queued sync.Map
+
+// Enqueue polls a new order. In push mode the order waits for the callback instead and
+// Reconcile polls it if the callback never comes.
+func Enqueue(order entity.Order) {
+	if PushMode {
+		return
+	}
+	enqueue(order)
+}
+
+// enqueue puts the order into the accrual queue. The caller never blocks, see push.
+func enqueue(order entity.Order) {
+	if _, loaded := queued.LoadOrStore(order.ID, struct{}{}); loaded {
+		return
+	}
+	push(order)
+}
+
+// retries are the timers of retryLater, stopped with the workers.
+var retriesMu sync.Mutex
+var retries = make(map[*time.Timer]struct{})
+var retriesStopped bool
+
+// retryLater puts the order into the queue after delay. The order counts as queued
+// meanwhile, so Reconcile doesn't poll it earlier. Once the workers have stopped the order
+// is left unfinished in the DB for Reconcile after a restart.
+func retryLater(order entity.Order, delay time.Duration) {
+	retriesMu.Lock()
+	defer retriesMu.Unlock()
+	if retriesStopped {
+		return
+	}
+	queued.Store(order.ID, struct{}{})
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		retriesMu.Lock()
+		delete(retries, timer)
+		stopped := retriesStopped
+		retriesMu.Unlock()
+		if !stopped {
+			push(order)
+		}
+	})
+	retries[timer] = struct{}{}
+}
+
+func startRetries() {
+	retriesMu.Lock()
+	defer retriesMu.Unlock()
+	retriesStopped = false
+}
+
+func stopRetries() {
+	retriesMu.Lock()
+	defer retriesMu.Unlock()
+	retriesStopped = true
+	for timer := range retries {
+		timer.Stop()
+	}
+	retries = make(map[*time.Timer]struct{})
+}
+
+// push drops the order when the queue is full. It stays unfinished in the DB, so Reconcile
+// queues it again once there is room.
+func push(order entity.Order) {
+	select {
+	case QueueCh <- order:
+	default:
+		queued.Delete(order.ID)
+		metrics.AccrualDropped.Inc()
+		log.Warn().Msgf("Accrual queue is full, order %s is left to reconciliation", order.ID)
+	}
+}
+
+// Fetch asks the provider of the order about it. A positive duration means the provider
+// can't be asked now: it limits the rate or its breaker is open.
+func Fetch(ctx context.Context, order entity.Order) (*entity.Order, time.Duration, error) {
+	return ProviderFor(order).GetAccrual(ctx, order.ID)
+}
+
+// Apply saves a result of the accrual system, whether it was polled or pushed. Results for
+// orders in a final status are ignored, so an order is credited only once.
+func Apply(ctx context.Context, db *dbmodule.DBStorage, orderID string, provider string, status string, accrual float32) error {
+	order, err := db.ApplyAccrual(ctx, orderID, provider, status, accrual)
+	if err != nil || order == nil {
+		return err
+	}
+	events.Default.Publish(ctx, order.UserID, events.TypeOrder, order)
+	if order.Accrual > 0 {
+		metrics.Credit(metrics.SourceAccrual, order.Accrual)
+		if balance := db.GetBalance(ctx, order.UserID); balance != nil {
+			events.Default.Publish(ctx, order.UserID, events.TypeBalance, balance)
+		}
+	}
+	return nil
+}
+
+// updateOrder polls the provider of the order once.
+func updateOrder(db *dbmodule.DBStorage, order entity.Order) {
 	ctx, cancel := context.WithTimeout(context.Background(), ContextCancelTimeout)
 	defer cancel()
-	order, retryAfter := getAccrual(accrualSystemAddress, orderID)
-	fmt.Printf("Get order from accrual system %v\n", order)
-	if order == nil {
-		return nil, retryAfter
+	provider := ProviderFor(order)
+	// the poll runs long after the upload request, so it gets its own trace linked to it
+	ctx, span := tracing.Tracer.Start(ctx, "accrual.poll", trace.WithLinks(tracing.Link(order.TraceParent)...),
+		trace.WithAttributes(attribute.String("order.number", order.ID), attribute.String("accrual.provider", provider.Name())))
+	defer span.End()
+	logContext := log.With().Str("order", order.ID).Str("accrual_provider", provider.Name()).
+		Str("trace_id", span.SpanContext().TraceID().String())
+	if links := tracing.Link(order.TraceParent); len(links) > 0 {
+		logContext = logContext.Str("upload_trace_id", links[0].SpanContext.TraceID().String())
+	}
+	logger := logContext.Logger()
+	ctx = logger.WithContext(ctx)
+	result, retryAfter, err := provider.GetAccrual(ctx, order.ID)
+	if retryAfter > 0 {
+		// the order is not to blame for rate limits and an open breaker, so the attempt
+		// is not counted
+		retryLater(order, retryAfter)
+		return
+	}
+	if errors.Is(err, ErrNotRegistered) {
+		span.SetAttributes(attribute.String("accrual.status", "NOT_REGISTERED"))
+		if !PushMode {
+			retryLater(order, BackoffBase)
+		}
+		return
 	}
-	status := order.Status
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		fail(ctx, db, order, err)
+		return
+	}
+	span.SetAttributes(attribute.String("accrual.status", result.Status))
 	/*if order.Status == REGISTERED {
 		status = PROCESSING
 	}*/ // no status REGISTERED in technical task
-	var errDBOrder *dbmodule.ErrorDB
-	if err := db.UpdateOrder(ctx, orderID, userID, status, order.Accrual); errors.As(err, &errDBOrder) {
-		log.Err(err)
-		return nil, 0
+	if err = Apply(ctx, db, order.ID, provider.Name(), result.Status, result.Accrual); err != nil {
+		log.Ctx(ctx).Error().Msgf("Couldn't save accrual of order %s: %v", order.ID, err)
+		retryLater(order, BackoffBase)
+		return
 	}
-	var errDBBalance *dbmodule.ErrorDB
-	if err := db.UpdateBalance(ctx, userID, order.Accrual); errors.As(err, &errDBBalance) {
-		log.Err(err)
-		return nil, 0
+	if (result.Status == REGISTERED || result.Status == PROCESSING) && !PushMode {
+		retryLater(order, PendingDelay)
 	}
-	return order, 0
 }
 
-func UpdateOrders(db *dbmodule.DBStorage) {
+// fail counts the failed attempt and retries the order with a backoff, or leaves it in the
+// dead-letter status once the retry budget is spent.
+func fail(ctx context.Context, db *dbmodule.DBStorage, order entity.Order, err error) {
+	log.Ctx(ctx).Warn().Msgf("Couldn't get accrual of order %s: %v", order.ID, err)
+	attempts, failed, errDB := db.FailAccrualAttempt(ctx, order.ID, err.Error(), MaxAttempts)
+	if errDB != nil {
+		log.Ctx(ctx).Error().Msgf("Couldn't save accrual failure of order %s: %v", order.ID, errDB)
+		retryLater(order, BackoffBase)
+		return
+	}
+	if failed != nil {
+		if orderDB := db.GetOrder(ctx, order.ID); orderDB != nil {
+			events.Default.Publish(ctx, orderDB.UserID, events.TypeOrder, orderDB)
+		}
+		return
+	}
+	if attempts > 0 {
+		retryLater(order, backoff.Exponential(BackoffBase, BackoffMax, attempts))
+	}
+}
+
+// UpdateOrders polls queued orders until ctx is done. The order being polled is finished
+// first; orders left in the queue stay unfinished in the DB and Reconcile takes them
+// again after a restart.
+func UpdateOrders(ctx context.Context, db *dbmodule.DBStorage) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	beat()
 	for {
-		order := <-QueueCh
-		accrualOrder, retryAfterNew := updateOrder(db, AccrualSystemAddress, order.ID, order.UserID)
-		if retryAfterNew > 0 {
-			retryAfter = retryAfterNew
-			QueueCh <- order
-		} else if retryAfter == 0 {
-			if accrualOrder == nil || accrualOrder.Status == REGISTERED || accrualOrder.Status == PROCESSING {
-				QueueCh <- order
-			}
+		select {
+		case <-ctx.Done():
+			return
+		case order := <-QueueCh:
+			queued.Delete(order.ID)
+			updateOrder(db, order)
+		case <-ticker.C:
+		}
+		beat()
+	}
+}
+
+var workersMu sync.Mutex
+var workersCh = make(chan int, 1)
+
+// SetWorkers changes the number of workers run by RunWorkers. Workers that are stopped
+// finish the order they are polling first.
+func SetWorkers(n int) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	select {
+	case <-workersCh:
+	default:
+	}
+	workersCh <- n
+}
+
+// RunWorkers runs n UpdateOrders workers until ctx is done and waits for them to stop.
+func RunWorkers(ctx context.Context, db *dbmodule.DBStorage, n int) {
+	var wg sync.WaitGroup
+	var stops []context.CancelFunc
+	resize := func(n int) {
+		for len(stops) < n {
+			workerCtx, stop := context.WithCancel(ctx)
+			stops = append(stops, stop)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				UpdateOrders(workerCtx, db)
+			}()
+		}
+		for len(stops) > n {
+			stops[len(stops)-1]()
+			stops = stops[:len(stops)-1]
+		}
+	}
+
+	startRetries()
+	resize(n)
+	for {
+		select {
+		case <-ctx.Done():
+			// pending retries would only fill the queue nobody reads anymore
+			stopRetries()
+			wg.Wait()
+			return
+		case n = <-workersCh:
+			log.Info().Msgf("Accrual workers: %d -> %d", len(stops), n)
+			resize(n)
+		}
+	}
+}
+
+func beat() {
+	atomic.StoreInt64(&heartbeat, time.Now().UnixNano())
+}
+
+// Heartbeat returns when the worker was last seen alive, zero time if it hasn't started.
+func Heartbeat() time.Time {
+	nanos := atomic.LoadInt64(&heartbeat)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Requeue polls the order right away, in push mode as well. It is used for orders taken
+// out of the dead-letter status.
+func Requeue(order entity.Order) {
+	enqueue(order)
+}
+
+// Reconcile periodically queues orders that have been waiting for the accrual system for
+// longer than ReconcileAfter. In push mode it is the only source of polling; it also picks
+// up orders whose queue entries were lost on restart.
+func Reconcile(ctx context.Context, db *dbmodule.DBStorage) {
+	ticker := time.NewTicker(ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		orders, err := db.GetUnfinishedOrders(ctx, ReconcileAfter, ReconcileBatchSize)
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("Couldn't get unfinished orders: %v", err)
+			continue
+		}
+		for _, order := range orders {
+			enqueue(order)
 		}
-		time.Sleep(time.Duration(retryAfter) * time.Second)
-		retryAfter = 0
 	}
 }
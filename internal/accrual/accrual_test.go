@@ -0,0 +1,97 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+func TestEnqueueDropsWhenFull(t *testing.T) {
+	queue := QueueCh
+	QueueCh = make(chan entity.Order, 1)
+	defer func() { QueueCh = queue }()
+
+	enqueue(entity.Order{ID: "18"})
+	enqueue(entity.Order{ID: "18"})
+	enqueue(entity.Order{ID: "26"})
+	if len(QueueCh) != 1 {
+		t.Fatalf("queue has %d orders, want 1", len(QueueCh))
+	}
+	if _, ok := queued.Load("26"); ok {
+		t.Error("dropped order counts as queued, Reconcile would skip it")
+	}
+	order := <-QueueCh
+	queued.Delete(order.ID)
+	if order.ID != "18" {
+		t.Errorf("queued order %s, want 18", order.ID)
+	}
+
+	// the dropped order can be queued again
+	enqueue(entity.Order{ID: "26"})
+	if len(QueueCh) != 1 {
+		t.Errorf("queue has %d orders, want 1", len(QueueCh))
+	}
+	queued.Delete((<-QueueCh).ID)
+}
+
+func TestNotRegisteredIsRetriedWithoutAttempt(t *testing.T) {
+	provider := newTestProvider(t, ProviderConfig{Name: DefaultProviderName}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if err := SetProviders(provider, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetProviders(nil, nil) }()
+	queue, timeout, base := QueueCh, ContextCancelTimeout, BackoffBase
+	QueueCh, ContextCancelTimeout, BackoffBase = make(chan entity.Order, 1), time.Second, 10*time.Millisecond
+	defer func() { QueueCh, ContextCancelTimeout, BackoffBase = queue, timeout, base }()
+
+	if _, _, err := provider.GetAccrual(context.Background(), "18"); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("GetAccrual() = %v, want ErrNotRegistered", err)
+	}
+	// a nil DB fails the test if the attempt is counted
+	updateOrder(nil, entity.Order{ID: "18"})
+	select {
+	case order := <-QueueCh:
+		queued.Delete(order.ID)
+		if order.ID != "18" {
+			t.Errorf("queued order %s, want 18", order.ID)
+		}
+	case <-time.After(time.Second):
+		t.Error("order was not polled again")
+	}
+}
+
+func TestRetriesStopWithWorkers(t *testing.T) {
+	queue := QueueCh
+	QueueCh = make(chan entity.Order, 1)
+	defer func() { QueueCh = queue }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunWorkers(ctx, nil, 0)
+		close(done)
+	}()
+	// RunWorkers has started when it takes the new worker count
+	SetWorkers(0)
+	for len(workersCh) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	retryLater(entity.Order{ID: "18"}, 50*time.Millisecond)
+	cancel()
+	<-done
+	retryLater(entity.Order{ID: "26"}, time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	if len(QueueCh) != 0 {
+		t.Errorf("order %s was queued after the workers stopped", (<-QueueCh).ID)
+	}
+	queued.Delete("18")
+	queued.Delete("26")
+	startRetries()
+}
@@ -0,0 +1,89 @@
+package accrual
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+// ResponseMapping adapts a provider whose responses differ from SPECIFICATION.md. Fields are
+// paths of JSON object keys separated by dots, e.g. "result.points"; empty ones keep the
+// names of the specification.
+type ResponseMapping struct {
+	Status  string `json:"status,omitempty"`
+	Accrual string `json:"accrual,omitempty"`
+	// Statuses maps the statuses of the provider to REGISTERED, INVALID, PROCESSING and
+	// PROCESSED. Statuses missing here are taken as they are.
+	Statuses map[string]string `json:"statuses,omitempty"`
+}
+
+// decoder turns the body of a 200 response into the order status and accrual.
+type decoder func(data []byte) (*entity.Order, error)
+
+func decodeSpecification(data []byte) (*entity.Order, error) {
+	order := entity.Order{}
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func newDecoder(mapping *ResponseMapping) decoder {
+	if mapping == nil {
+		return decodeSpecification
+	}
+	statusPath := splitPath(mapping.Status, "status")
+	accrualPath := splitPath(mapping.Accrual, "accrual")
+	return func(data []byte) (*entity.Order, error) {
+		var response interface{}
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&response); err != nil {
+			return nil, err
+		}
+
+		status, ok := lookup(response, statusPath).(string)
+		if !ok {
+			return nil, fmt.Errorf("no string at %s", strings.Join(statusPath, "."))
+		}
+		if mapped, ok := mapping.Statuses[status]; ok {
+			status = mapped
+		}
+		order := entity.Order{Status: status}
+
+		switch accrual := lookup(response, accrualPath).(type) {
+		case nil:
+		case json.Number:
+			value, err := strconv.ParseFloat(accrual.String(), 32)
+			if err != nil {
+				return nil, fmt.Errorf("wrong accrual at %s: %v", strings.Join(accrualPath, "."), err)
+			}
+			order.Accrual = float32(value)
+		default:
+			return nil, fmt.Errorf("no number at %s", strings.Join(accrualPath, "."))
+		}
+		return &order, nil
+	}
+}
+
+func splitPath(path string, fallback string) []string {
+	if path == "" {
+		path = fallback
+	}
+	return strings.Split(path, ".")
+}
+
+// lookup returns the value at path, or nil if there is none.
+func lookup(value interface{}, path []string) interface{} {
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
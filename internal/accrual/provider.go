@@ -0,0 +1,270 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/breaker"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+	"github.com/fortuna91/ya_praktikum_final/internal/metrics"
+	"github.com/fortuna91/ya_praktikum_final/internal/tracing"
+)
+
+// DefaultProviderName is the provider of orders no route matches.
+const DefaultProviderName = "default"
+
+// Provider calculates accruals for orders. A positive duration returned by GetAccrual means
+// the provider can't be asked now, because it limits the rate or is failing; the order must
+// be retried after it without counting an attempt.
+type Provider interface {
+	Name() string
+	GetAccrual(ctx context.Context, orderID string) (*entity.Order, time.Duration, error)
+}
+
+// BreakerProvider is implemented by providers guarded by a circuit breaker.
+type BreakerProvider interface {
+	BreakerState() breaker.State
+}
+
+type ProviderConfig struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// Path of the order request, {number} is replaced with the order number.
+	Path          string   `json:"path,omitempty"`
+	Prefixes      []string `json:"prefixes,omitempty"`
+	Partners      []string `json:"partners,omitempty"`
+	Timeout       string   `json:"timeout,omitempty"`
+	MaxIdleConns  int      `json:"max_idle_conns,omitempty"`
+	BreakerErrors int      `json:"breaker_errors,omitempty"`
+	BreakerOpen   string   `json:"breaker_open,omitempty"`
+	// Response adapts the response of a provider that doesn't follow SPECIFICATION.md.
+	Response *ResponseMapping `json:"response,omitempty"`
+}
+
+// ParseProviders reads a JSON array of provider configs.
+func ParseProviders(data string) ([]ProviderConfig, error) {
+	var configs []ProviderConfig
+	if data == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(data), &configs); err != nil {
+		return nil, fmt.Errorf("wrong accrual providers config: %v", err)
+	}
+	return configs, nil
+}
+
+// HTTPProvider speaks the protocol of the accrual system from SPECIFICATION.md,
+// GET <address>/api/orders/{number}, with its own client and circuit breaker. The path and
+// the response fields can be adapted to other providers.
+type HTTPProvider struct {
+	name    string
+	url     string
+	decode  decoder
+	client  *http.Client
+	breaker *breaker.Breaker
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func NewHTTPProvider(config ProviderConfig) (*HTTPProvider, error) {
+	if config.Name == "" || config.Address == "" {
+		return nil, fmt.Errorf("accrual provider needs a name and an address")
+	}
+	timeout, err := durationOr(config.Timeout, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("wrong timeout of accrual provider %s: %v", config.Name, err)
+	}
+	breakerOpen, err := durationOr(config.BreakerOpen, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("wrong breaker_open of accrual provider %s: %v", config.Name, err)
+	}
+	if config.Path == "" {
+		config.Path = "/api/orders/{number}"
+	}
+	if config.MaxIdleConns == 0 {
+		config.MaxIdleConns = 10
+	}
+	if config.BreakerErrors == 0 {
+		config.BreakerErrors = 5
+	}
+	return &HTTPProvider{
+		name:    config.Name,
+		url:     strings.TrimSuffix(config.Address, "/") + config.Path,
+		decode:  newDecoder(config.Response),
+		client:  NewClient(timeout, config.MaxIdleConns),
+		breaker: breaker.New(config.BreakerErrors, breakerOpen),
+	}, nil
+}
+
+func durationOr(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// NewClient returns an HTTP client with a timeout and a pool of idle connections.
+func NewClient(timeout time.Duration, maxIdleConns int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	return &http.Client{Timeout: timeout, Transport: tracing.Transport(transport)}
+}
+
+func (p *HTTPProvider) Name() string {
+	return p.name
+}
+
+func (p *HTTPProvider) BreakerState() breaker.State {
+	return p.breaker.State()
+}
+
+func (p *HTTPProvider) Breaker() *breaker.Breaker {
+	return p.breaker
+}
+
+func (p *HTTPProvider) GetAccrual(ctx context.Context, orderID string) (*entity.Order, time.Duration, error) {
+	p.mu.Lock()
+	paused := time.Until(p.pausedUntil)
+	p.mu.Unlock()
+	if paused > 0 {
+		return nil, paused, nil
+	}
+	if wait, err := p.breaker.Allow(); err != nil {
+		// the work is deferred until the breaker lets a probe through
+		return nil, wait, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(p.url, "{number}", orderID), nil)
+	if err != nil {
+		p.breaker.Success()
+		return nil, 0, err
+	}
+	metrics.AccrualInFlight.Inc()
+	response, err := p.client.Do(request)
+	metrics.AccrualInFlight.Dec()
+	if err != nil {
+		p.breaker.Failure()
+		return nil, 0, fmt.Errorf("accrual provider %s is unreachable: %v", p.name, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusInternalServerError {
+		p.breaker.Failure()
+	} else {
+		p.breaker.Success()
+	}
+	if response.StatusCode == http.StatusTooManyRequests {
+		retryAfter, _ := strconv.Atoi(response.Header.Get("Retry-After"))
+		if retryAfter <= 0 {
+			retryAfter = 1
+		}
+		wait := time.Duration(retryAfter) * time.Second
+		metrics.AccrualRateLimited.WithLabelValues(p.name).Inc()
+		metrics.AccrualRetryAfter.WithLabelValues(p.name).Set(wait.Seconds())
+		p.mu.Lock()
+		p.pausedUntil = time.Now().Add(wait)
+		p.mu.Unlock()
+		return nil, wait, nil
+	} else if response.StatusCode == http.StatusNoContent {
+		return nil, 0, ErrNotRegistered
+	} else if response.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("accrual provider %s response code %d", p.name, response.StatusCode)
+	}
+	respBody, err := body.ReadAll(body.LimitReader(response.Body, body.MaxSize))
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't read accrual provider %s response: %v", p.name, err)
+	}
+	orderResponse, errDecode := p.decode(respBody)
+	if errDecode != nil {
+		return nil, 0, fmt.Errorf("malformed accrual provider %s response: %v", p.name, errDecode)
+	}
+	return orderResponse, 0, nil
+}
+
+type route struct {
+	provider Provider
+	prefixes []string
+	partners map[string]bool
+}
+
+var providersMu sync.RWMutex
+var defaultProvider Provider
+var routes []route
+
+// SetProviders sets the provider used when no route matches and the routed providers.
+func SetProviders(fallback Provider, configs []ProviderConfig) error {
+	var newRoutes []route
+	for _, config := range configs {
+		provider, err := NewHTTPProvider(config)
+		if err != nil {
+			return err
+		}
+		partners := make(map[string]bool, len(config.Partners))
+		for _, partner := range config.Partners {
+			partners[partner] = true
+		}
+		newRoutes = append(newRoutes, route{provider: provider, prefixes: config.Prefixes, partners: partners})
+	}
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	defaultProvider = fallback
+	routes = newRoutes
+	return nil
+}
+
+// Providers returns all providers, the default one first.
+func Providers() []Provider {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	result := []Provider{defaultProvider}
+	for _, r := range routes {
+		result = append(result, r.provider)
+	}
+	return result
+}
+
+// ProviderFor returns the provider of the order. The provider that has already credited
+// the order keeps it; otherwise the partner that submitted the order decides, then the
+// longest matching number prefix, then the default provider.
+func ProviderFor(order entity.Order) Provider {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	if order.Provider == DefaultProviderName {
+		return defaultProvider
+	}
+	if order.Provider != "" {
+		for _, r := range routes {
+			if r.provider.Name() == order.Provider {
+				return r.provider
+			}
+		}
+	}
+	if order.Partner != "" {
+		for _, r := range routes {
+			if r.partners[order.Partner] {
+				return r.provider
+			}
+		}
+	}
+	var matched Provider
+	longest := 0
+	for _, r := range routes {
+		for _, prefix := range r.prefixes {
+			if len(prefix) > longest && strings.HasPrefix(order.ID, prefix) {
+				matched, longest = r.provider, len(prefix)
+			}
+		}
+	}
+	if matched != nil {
+		return matched
+	}
+	return defaultProvider
+}
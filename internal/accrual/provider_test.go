@@ -0,0 +1,168 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+func newTestProvider(t *testing.T, config ProviderConfig, handler http.HandlerFunc) *HTTPProvider {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	config.Address = server.URL
+	if config.Name == "" {
+		config.Name = "test"
+	}
+	provider, err := NewHTTPProvider(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestHTTPProviderResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ProviderConfig
+		path     string
+		response string
+		want     entity.Order
+	}{
+		{
+			name:     "specification",
+			path:     "/api/orders/79927398713",
+			response: `{"order":"79927398713","status":"PROCESSED","accrual":500.5}`,
+			want:     entity.Order{Status: "PROCESSED", Accrual: 500.5},
+		},
+		{
+			name:     "specification without accrual",
+			path:     "/api/orders/79927398713",
+			response: `{"order":"79927398713","status":"PROCESSING"}`,
+			want:     entity.Order{Status: "PROCESSING"},
+		},
+		{
+			name: "mapped",
+			config: ProviderConfig{Path: "/v2/receipts/{number}", Response: &ResponseMapping{
+				Status: "state", Accrual: "result.points",
+				Statuses: map[string]string{"done": "PROCESSED", "rejected": "INVALID"},
+			}},
+			path:     "/v2/receipts/79927398713",
+			response: `{"id":"79927398713","state":"done","result":{"points":42}}`,
+			want:     entity.Order{Status: "PROCESSED", Accrual: 42},
+		},
+		{
+			name:     "mapped status without accrual",
+			config:   ProviderConfig{Response: &ResponseMapping{Statuses: map[string]string{"rejected": "INVALID"}}},
+			path:     "/api/orders/79927398713",
+			response: `{"status":"rejected"}`,
+			want:     entity.Order{Status: "INVALID"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newTestProvider(t, tt.config, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tt.path {
+					t.Errorf("path = %s, want %s", r.URL.Path, tt.path)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(tt.response))
+			})
+			order, wait, err := provider.GetAccrual(context.Background(), "79927398713")
+			if err != nil || wait != 0 {
+				t.Fatalf("GetAccrual() = %v, %v", wait, err)
+			}
+			if order.Status != tt.want.Status || order.Accrual != tt.want.Accrual {
+				t.Errorf("GetAccrual() = %+v, want %+v", *order, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPProviderMalformedResponses(t *testing.T) {
+	mapping := &ResponseMapping{Status: "state", Accrual: "result.points"}
+	for _, response := range []string{`not json`, `{"state":1}`, `{"state":"done","result":{"points":"many"}}`} {
+		provider := newTestProvider(t, ProviderConfig{Response: mapping}, func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(response))
+		})
+		if _, _, err := provider.GetAccrual(context.Background(), "18"); err == nil {
+			t.Errorf("no error for %s", response)
+		}
+	}
+}
+
+func TestHTTPProviderUnreadableResponses(t *testing.T) {
+	defer func(size int64) { body.MaxSize = size }(body.MaxSize)
+	body.MaxSize = 16
+	tooLarge := newTestProvider(t, ProviderConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"PROCESSED","accrual":500.5}`))
+	})
+	if order, _, err := tooLarge.GetAccrual(context.Background(), "18"); err == nil {
+		t.Errorf("GetAccrual() = %+v for a response over MaxSize, want an error", order)
+	}
+
+	cutOff := newTestProvider(t, ProviderConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte(`{"status":`))
+	})
+	if order, _, err := cutOff.GetAccrual(context.Background(), "18"); err == nil {
+		t.Errorf("GetAccrual() = %+v for a cut off response, want an error", order)
+	}
+}
+
+func TestHTTPProviderRateLimit(t *testing.T) {
+	calls := 0
+	provider := newTestProvider(t, ProviderConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	for i := 0; i < 2; i++ {
+		order, wait, err := provider.GetAccrual(context.Background(), "18")
+		if order != nil || err != nil || wait <= 29*time.Second || wait > 30*time.Second {
+			t.Errorf("GetAccrual() = %v, %v, %v, want a 30s wait", order, wait, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("provider was called %d times during the pause", calls)
+	}
+}
+
+func TestProviderFor(t *testing.T) {
+	fallback := newTestProvider(t, ProviderConfig{Name: DefaultProviderName}, http.NotFound)
+	err := SetProviders(fallback, []ProviderConfig{
+		{Name: "partner", Address: "http://partner.example", Partners: []string{"shop"}},
+		{Name: "short", Address: "http://short.example", Prefixes: []string{"4"}},
+		{Name: "long", Address: "http://long.example", Prefixes: []string{"4561"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetProviders(nil, nil) }()
+
+	tests := []struct {
+		order entity.Order
+		want  string
+	}{
+		{entity.Order{ID: "79927398713"}, DefaultProviderName},
+		{entity.Order{ID: "4000000000000002"}, "short"},
+		{entity.Order{ID: "4561261212345467"}, "long"},
+		{entity.Order{ID: "4561261212345467", Partner: "shop"}, "partner"},
+		{entity.Order{ID: "4561261212345467", Partner: "unknown"}, "long"},
+		{entity.Order{ID: "4561261212345467", Provider: "short"}, "short"},
+		// the provider that has credited the order keeps it, the default one too
+		{entity.Order{ID: "4561261212345467", Partner: "shop", Provider: DefaultProviderName}, DefaultProviderName},
+		// a provider removed from the config gives the order back to routing
+		{entity.Order{ID: "4561261212345467", Provider: "removed"}, "long"},
+	}
+	for _, tt := range tests {
+		if got := ProviderFor(tt.order).Name(); got != tt.want {
+			t.Errorf("ProviderFor(%+v) = %s, want %s", tt.order, got, tt.want)
+		}
+	}
+}
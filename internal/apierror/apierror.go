@@ -0,0 +1,107 @@
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+const ContentType = "application/problem+json"
+
+const (
+	CodeBadRequest           = "bad_request"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeInternal             = "internal_error"
+	CodeTooManyRequests      = "too_many_requests"
+	CodeValidationFailed     = "validation_failed"
+
+	CodeLoginExists             = "login_exists"
+	CodeUnknownLogin            = "unknown_login"
+	CodeWrongPassword           = "wrong_password"
+	CodeInvalidOrderNumber      = "invalid_order_number"
+	CodeOrderOwnedByAnotherUser = "order_owned_by_another_user"
+	CodeOrderNotFound           = "order_not_found"
+	CodeOrderNotFailed          = "order_not_failed"
+	CodeInsufficientFunds       = "insufficient_funds"
+
+	CodeWebhookNotFound  = "webhook_not_found"
+	CodeDeliveryNotFound = "webhook_delivery_not_found"
+
+	CodePartnerExists   = "partner_exists"
+	CodePartnerNotFound = "partner_not_found"
+
+	CodePromoExists       = "promo_exists"
+	CodePromoNotFound     = "promo_not_found"
+	CodePromoNotActive    = "promo_not_active"
+	CodePromoExpired      = "promo_expired"
+	CodePromoExhausted    = "promo_exhausted"
+	CodePromoLimitReached = "promo_limit_reached"
+)
+
+// Error is an RFC 7807 problem details object. Code is stable and meant for machines,
+// Detail is a human-readable explanation of this particular occurrence.
+type Error struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Code     string `json:"code"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func New(status int, code string, detail string) *Error {
+	return &Error{
+		Type:   "/errors/" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+func Validation(fields ...FieldError) *Error {
+	apiErr := New(http.StatusBadRequest, CodeValidationFailed, "request validation failed")
+	apiErr.Errors = fields
+	return apiErr
+}
+
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return e.Code + ": " + e.Detail
+	}
+	return e.Code
+}
+
+func Write(w http.ResponseWriter, r *http.Request, apiErr *Error) {
+	problem := *apiErr
+	ctx := context.Background()
+	if r != nil {
+		problem.Instance = r.URL.Path
+		ctx = r.Context()
+	}
+	bodyResp, err := json.Marshal(problem)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("Cannot convert error to JSON: %v", err)
+		http.Error(w, problem.Code, problem.Status)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	if _, errBody := w.Write(bodyResp); errBody != nil {
+		log.Ctx(ctx).Error().Msgf("Error sending the response: %v\n", errBody)
+	}
+}
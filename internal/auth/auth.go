@@ -9,16 +9,27 @@ import (
 	"github.com/fortuna91/ya_praktikum_final/internal/entity"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-var TokenDuration time.Duration
 var mySigningKey = []byte("secret")
 
+// tokenDuration is read by every login and may be changed by a config reload.
+var tokenDuration int64
+
+func SetTokenDuration(d time.Duration) {
+	atomic.StoreInt64(&tokenDuration, int64(d))
+}
+
+func TokenDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&tokenDuration))
+}
+
 func SetToken(userRequest *entity.User) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &entity.User{
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: jwt.At(time.Now().Add(TokenDuration)),
+			ExpiresAt: jwt.At(time.Now().Add(TokenDuration())),
 			IssuedAt:  jwt.At(time.Now()),
 		},
 		Login: userRequest.Login,
@@ -0,0 +1,19 @@
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Exponential returns base doubled for every attempt after the first, capped at max, with
+// up to 20% of jitter so that retries of many failures don't come at once.
+func Exponential(base time.Duration, max time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
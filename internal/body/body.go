@@ -1,19 +1,116 @@
 package body
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
 
-func GetBody(readerBody io.ReadCloser) *[]byte {
-	defer readerBody.Close()
+// MaxSize bounds bodies of other services, e.g. responses of the accrual system.
+var MaxSize int64 = 1 << 20
+
+var ErrTooLarge = errors.New("body is too large")
+
+// ErrCorrupt is returned while reading a compressed request body that can't be unpacked.
+var ErrCorrupt = errors.New("corrupt compressed body")
 
-	respBody, err := ioutil.ReadAll(readerBody)
+func GetBody(readerBody io.ReadCloser) *[]byte {
+	respBody, err := ReadAll(LimitReader(readerBody, MaxSize))
 	if err != nil {
 		log.Error().Msgf("Couldn't read body %v\n", err)
 		return nil
 	}
 	return &respBody
 }
+
+func ReadAll(readerBody io.ReadCloser) ([]byte, error) {
+	defer readerBody.Close()
+	return ioutil.ReadAll(readerBody)
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	left int64
+}
+
+// LimitReader returns ErrTooLarge as soon as more than limit bytes are read.
+func LimitReader(readerBody io.ReadCloser, limit int64) io.ReadCloser {
+	return &limitedReader{ReadCloser: readerBody, left: limit}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n + int(l.left), ErrTooLarge
+	}
+	return n, err
+}
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+var ErrMalformedJSON = errors.New("malformed JSON")
+
+// ErrUnknownField is returned for an unknown field whose name couldn't be found out.
+var ErrUnknownField = errors.New("unknown field in JSON")
+
+// DecodeJSON strictly decodes a single JSON object: unknown fields and trailing data
+// are rejected. Field problems are returned as *FieldError.
+func DecodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return &FieldError{Field: typeErr.Field, Message: "must be " + typeErr.Type.String()}
+		}
+		if field, ok := unknownField(err); ok {
+			if field == "" {
+				return ErrUnknownField
+			}
+			return &FieldError{Field: field, Message: "unknown field"}
+		}
+		return ErrMalformedJSON
+	}
+	if decoder.More() {
+		return ErrMalformedJSON
+	}
+	return nil
+}
+
+const unknownFieldPrefix = "json: unknown field "
+
+// unknownField tells whether err is about an unknown field and returns its name.
+// encoding/json has no error type for it, so the name is taken from the text; it is ""
+// when the text is not in the expected format.
+func unknownField(err error) (string, bool) {
+	text := err.Error()
+	if !strings.HasPrefix(text, unknownFieldPrefix) {
+		return "", false
+	}
+	field, errUnquote := strconv.Unquote(strings.TrimPrefix(text, unknownFieldPrefix))
+	if errUnquote != nil {
+		return "", true
+	}
+	return field, true
+}
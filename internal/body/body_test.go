@@ -0,0 +1,63 @@
+package body
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	type request struct {
+		Login string  `json:"login"`
+		Sum   float32 `json:"sum"`
+	}
+	tests := []struct {
+		name  string
+		data  string
+		err   error
+		field *FieldError
+	}{
+		{name: "valid", data: `{"login":"gopher","sum":1.5}`},
+		{name: "unknown field", data: `{"login":"gopher","password":"x"}`,
+			field: &FieldError{Field: "password", Message: "unknown field"}},
+		{name: "unknown field with quotes", data: `{"pass\"word":"x"}`,
+			field: &FieldError{Field: `pass"word`, Message: "unknown field"}},
+		{name: "wrong type", data: `{"sum":"many"}`, field: &FieldError{Field: "sum", Message: "must be float32"}},
+		{name: "malformed", data: `{"login":`, err: ErrMalformedJSON},
+		{name: "trailing data", data: `{"login":"gopher"} {}`, err: ErrMalformedJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v request
+			err := DecodeJSON([]byte(tt.data), &v)
+			var fieldErr *FieldError
+			switch {
+			case tt.field != nil:
+				if !errors.As(err, &fieldErr) || *fieldErr != *tt.field {
+					t.Errorf("DecodeJSON() = %v, want %v", err, tt.field)
+				}
+			case err != tt.err:
+				t.Errorf("DecodeJSON() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUnknownField(t *testing.T) {
+	tests := []struct {
+		err   error
+		field string
+		ok    bool
+	}{
+		{errors.New(`json: unknown field "password"`), "password", true},
+		// another wording of a future Go release still gets a generic error
+		{errors.New(`json: unknown field password`), "", true},
+		{errors.New(`json: unknown field "password" in request`), "", true},
+		{errors.New(`unexpected EOF`), "", false},
+	}
+	for _, tt := range tests {
+		field, ok := unknownField(tt.err)
+		if field != tt.field || ok != tt.ok {
+			t.Errorf("unknownField(%q) = %q, %v, want %q, %v", tt.err, field, ok, tt.field, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Breaker stops calls to a failing service. After Threshold failures in a row it opens and
+// rejects calls for OpenTimeout, then lets a single probe through (half-open): a successful
+// probe closes it, a failed one opens it again.
+type Breaker struct {
+	mu          sync.Mutex
+	threshold   int
+	openTimeout time.Duration
+	state       State
+	failures    int
+	openedAt    time.Time
+	probing     bool
+	onChange    func(from State, to State)
+	// now is replaced by a fake clock in tests
+	now func() time.Time
+}
+
+func New(threshold int, openTimeout time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, openTimeout: openTimeout, now: time.Now}
+}
+
+// OnStateChange sets a function called on every state change, e.g. to log or count it.
+// It is called with the breaker locked and must not call the breaker back.
+func (b *Breaker) OnStateChange(fn func(from State, to State)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onChange = fn
+}
+
+// Allow returns ErrOpen and the time left until the next probe when the call must not be
+// made. Otherwise the caller must report the result with Success or Failure.
+func (b *Breaker) Allow() (time.Duration, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		left := b.openTimeout - b.now().Sub(b.openedAt)
+		if left > 0 {
+			return left, ErrOpen
+		}
+		b.setState(HalfOpen)
+		b.probing = true
+		return 0, nil
+	case HalfOpen:
+		if b.probing {
+			return b.openTimeout, ErrOpen
+		}
+		b.probing = true
+	}
+	return 0, nil
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+	if b.state != Closed {
+		b.setState(Closed)
+	}
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.threshold) {
+		b.openedAt = b.now()
+		b.setState(Open)
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *Breaker) setState(state State) {
+	from := b.state
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(from, state)
+	}
+}
@@ -0,0 +1,181 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestBreaker(threshold int, openTimeout time.Duration) (*Breaker, *clock) {
+	c := &clock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := New(threshold, openTimeout)
+	b.now = c.Now
+	return b, c
+}
+
+// step is one action on the breaker, "allow", "reject", "success", "failure" or "wait", and
+// the state after it.
+type step struct {
+	action string
+	wait   time.Duration
+	state  State
+}
+
+func TestBreaker(t *testing.T) {
+	const openTimeout = 30 * time.Second
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"opens after threshold failures in a row", []step{
+			{action: "allow", state: Closed}, {action: "failure", state: Closed},
+			{action: "allow", state: Closed}, {action: "failure", state: Closed},
+			{action: "allow", state: Closed}, {action: "failure", state: Open},
+			{action: "reject", state: Open},
+		}},
+		{"success resets the failures", []step{
+			{action: "failure", state: Closed}, {action: "failure", state: Closed},
+			{action: "success", state: Closed},
+			{action: "failure", state: Closed}, {action: "failure", state: Closed},
+			{action: "allow", state: Closed},
+		}},
+		{"stays open until the timeout", []step{
+			{action: "failure", state: Closed}, {action: "failure", state: Closed}, {action: "failure", state: Open},
+			{action: "wait", wait: openTimeout - time.Second, state: Open},
+			{action: "reject", state: Open},
+		}},
+		{"lets a single probe through", []step{
+			{action: "failure", state: Closed}, {action: "failure", state: Closed}, {action: "failure", state: Open},
+			{action: "wait", wait: openTimeout, state: Open},
+			{action: "allow", state: HalfOpen},
+			{action: "reject", state: HalfOpen},
+			{action: "reject", state: HalfOpen},
+		}},
+		{"failed probe opens it again", []step{
+			{action: "failure", state: Closed}, {action: "failure", state: Closed}, {action: "failure", state: Open},
+			{action: "wait", wait: openTimeout, state: Open},
+			{action: "allow", state: HalfOpen},
+			{action: "failure", state: Open},
+			{action: "reject", state: Open},
+			{action: "wait", wait: openTimeout, state: Open},
+			{action: "allow", state: HalfOpen},
+		}},
+		{"successful probe closes it", []step{
+			{action: "failure", state: Closed}, {action: "failure", state: Closed}, {action: "failure", state: Open},
+			{action: "wait", wait: openTimeout, state: Open},
+			{action: "allow", state: HalfOpen},
+			{action: "success", state: Closed},
+			{action: "allow", state: Closed},
+			{action: "allow", state: Closed},
+			// the failures before opening don't count anymore
+			{action: "failure", state: Closed},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, c := newTestBreaker(3, openTimeout)
+			for i, s := range tt.steps {
+				switch s.action {
+				case "allow":
+					if wait, err := b.Allow(); err != nil {
+						t.Fatalf("step %d: Allow() = %v, %v, want the call allowed", i, wait, err)
+					}
+				case "reject":
+					wait, err := b.Allow()
+					if !errors.Is(err, ErrOpen) || wait <= 0 || wait > openTimeout {
+						t.Fatalf("step %d: Allow() = %v, %v, want ErrOpen and a wait", i, wait, err)
+					}
+				case "success":
+					b.Success()
+				case "failure":
+					b.Failure()
+				case "wait":
+					c.Advance(s.wait)
+				}
+				if got := b.State(); got != s.state {
+					t.Fatalf("step %d %s: state %s, want %s", i, s.action, got, s.state)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerWaitLeft(t *testing.T) {
+	b, c := newTestBreaker(1, 30*time.Second)
+	b.Failure()
+	c.Advance(10 * time.Second)
+	if wait, err := b.Allow(); !errors.Is(err, ErrOpen) || wait != 20*time.Second {
+		t.Errorf("Allow() = %v, %v, want ErrOpen and 20s", wait, err)
+	}
+}
+
+func TestBreakerSingleProbeConcurrently(t *testing.T) {
+	b, c := newTestBreaker(1, time.Second)
+	b.Failure()
+	c.Advance(time.Second)
+
+	const callers = 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	start := make(chan struct{})
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := b.Allow(); err == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if allowed != 1 {
+		t.Errorf("%d of %d concurrent callers were let through half-open, want 1", allowed, callers)
+	}
+	if b.State() != HalfOpen {
+		t.Errorf("state %s, want half-open", b.State())
+	}
+}
+
+func TestBreakerOnStateChange(t *testing.T) {
+	b, c := newTestBreaker(1, time.Second)
+	var changes []string
+	b.OnStateChange(func(from State, to State) {
+		changes = append(changes, from.String()+"->"+to.String())
+	})
+	b.Failure()
+	c.Advance(time.Second)
+	_, _ = b.Allow()
+	b.Success()
+	want := []string{"closed->open", "open->half-open", "half-open->closed"}
+	if len(changes) != len(want) {
+		t.Fatalf("changes %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("changes %v, want %v", changes, want)
+		}
+	}
+}
@@ -2,57 +2,225 @@ package configs
 
 import (
 	"flag"
-	"github.com/caarlos0/env/v6"
 	"log"
+	"os"
+	"strings"
 	"time"
+
+	"github.com/caarlos0/env/v6"
 )
 
 type ServerConfig struct {
+	// ConfigFile is set by -config or CONFIG_FILE only.
+	ConfigFile string `env:"CONFIG_FILE" envDefault:""`
+
 	Address       string `env:"RUN_ADDRESS" envDefault:"127.0.0.1:8080"`
-	DB            string `env:"DATABASE_URI" envDefault:""`
-	AccrualSystem string `env:"ACCRUAL_SYSTEM_ADDRESS" envDefault:"127.0.0.1:8080"`
+	DB            string `env:"DATABASE_URI" envDefault:"" secret:"true"`
+	AccrualSystem string `env:"ACCRUAL_SYSTEM_ADDRESS" envDefault:"http://127.0.0.1:8080"`
+	// Migrate creates and upgrades the tables on start. Without it the schema is upgraded by
+	// gophermartctl migrate and the server is not ready until the schema is new enough.
+	Migrate bool `env:"MIGRATE" envDefault:"true"`
 
-	ContextCancel      time.Duration `env:"CANCEL_INTERVAL" envDefault:"2s"`
-	TokenDuration      time.Duration `env:"TOKEN_DURATION" envDefault:"1h"`
+	ContextCancel   time.Duration `env:"CANCEL_INTERVAL" envDefault:"2s"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	// ShutdownDrainDelay is how long the server keeps serving after /readyz starts failing,
+	// so load balancers stop sending requests before the listener is closed.
+	ShutdownDrainDelay time.Duration `env:"SHUTDOWN_DRAIN_DELAY" envDefault:"5s"`
+	TokenDuration      time.Duration `env:"TOKEN_DURATION" envDefault:"1h" reload:"true"`
 	AccrualChannelPool int           `env:"ACCRUAL_CHANNEL_POOL" envDefault:"100"`
-	HashKey            string        `env:"HASH_KEY" envDefault:"someKey"`
+	AccrualWorkers     int           `env:"ACCRUAL_WORKERS" envDefault:"1" reload:"true"`
+	// LogLevel is debug by default, the level the server has always logged at.
+	LogLevel string `env:"LOG_LEVEL" envDefault:"debug" reload:"true"`
+	// ConfigWatchInterval is how often the config file is checked for changes, 0 turns
+	// watching off. SIGHUP reloads the config anyway.
+	ConfigWatchInterval time.Duration `env:"CONFIG_WATCH_INTERVAL" envDefault:"5s"`
+	HashKey             string        `env:"HASH_KEY" envDefault:"someKey" secret:"true"`
+
+	AccrualCallbackSecret string        `env:"ACCRUAL_CALLBACK_SECRET" envDefault:"" secret:"true"`
+	AccrualReconcile      time.Duration `env:"ACCRUAL_RECONCILE_INTERVAL" envDefault:"1m"`
+	AccrualReconcileAfter time.Duration `env:"ACCRUAL_RECONCILE_AFTER" envDefault:"5m"`
+	AccrualMaxAttempts    int           `env:"ACCRUAL_MAX_ATTEMPTS" envDefault:"10"`
+	AccrualBackoffBase    time.Duration `env:"ACCRUAL_BACKOFF_BASE" envDefault:"5s"`
+	AccrualBackoffMax     time.Duration `env:"ACCRUAL_BACKOFF_MAX" envDefault:"30m"`
+	AccrualTimeout        time.Duration `env:"ACCRUAL_TIMEOUT" envDefault:"5s"`
+	AccrualMaxIdleConns   int           `env:"ACCRUAL_MAX_IDLE_CONNS" envDefault:"10"`
+	AccrualBreakerErrors  int           `env:"ACCRUAL_BREAKER_ERRORS" envDefault:"5"`
+	AccrualBreakerOpen    time.Duration `env:"ACCRUAL_BREAKER_OPEN" envDefault:"30s"`
+	// AccrualProviders is a JSON array of accrual.ProviderConfig for orders routed away
+	// from the accrual system at AccrualSystem.
+	AccrualProviders string `env:"ACCRUAL_PROVIDERS" envDefault:""`
+
+	ReconcileInterval time.Duration `env:"RECONCILE_INTERVAL" envDefault:"1h"`
+	ReconcileWindow   time.Duration `env:"RECONCILE_WINDOW" envDefault:"72h"`
+	ReconcileCorrect  bool          `env:"RECONCILE_CORRECT" envDefault:"false"`
+	ReconcileDryRun   bool          `env:"RECONCILE_DRY_RUN" envDefault:"false"`
+
+	TracingExporter    string  `env:"TRACING_EXPORTER" envDefault:"none"`
+	TracingEndpoint    string  `env:"TRACING_ENDPOINT" envDefault:"localhost:4318"`
+	TracingSampleRatio float64 `env:"TRACING_SAMPLE_RATIO" envDefault:"1"`
+
+	// RateLimits is a list of group=requests/period, see ratelimit.ParseLimits.
+	RateLimits     string `env:"RATE_LIMITS" envDefault:"auth=10/1m,orders=60/1m,balance=120/1m,default=300/1m" reload:"true"`
+	RateLimitStore string `env:"RATE_LIMIT_STORE" envDefault:"memory"`
+
+	DecompressLimit int64 `env:"DECOMPRESS_LIMIT" envDefault:"1048576"`
+	CompressMinSize int   `env:"COMPRESS_MIN_SIZE" envDefault:"1024"`
+
+	BodyLimit         int64 `env:"BODY_LIMIT" envDefault:"65536"`
+	OrderBodyLimit    int64 `env:"ORDER_BODY_LIMIT" envDefault:"256"`
+	BatchBodyLimit    int64 `env:"BATCH_BODY_LIMIT" envDefault:"1048576"`
+	BatchMaxOrders    int   `env:"BATCH_MAX_ORDERS" envDefault:"1000"`
+	PasswordMinLength int   `env:"PASSWORD_MIN_LENGTH" envDefault:"6"`
+
+	EventsHeartbeat   time.Duration `env:"EVENTS_HEARTBEAT" envDefault:"15s"`
+	EventsHistorySize int           `env:"EVENTS_HISTORY_SIZE" envDefault:"100"`
+	EventsPGNotify    bool          `env:"EVENTS_PG_NOTIFY" envDefault:"false"`
+
+	WebhookPollInterval time.Duration `env:"WEBHOOK_POLL_INTERVAL" envDefault:"2s"`
+	WebhookMaxAttempts  int           `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"8"`
+	WebhookBackoffBase  time.Duration `env:"WEBHOOK_BACKOFF_BASE" envDefault:"10s"`
+	WebhookTimeout      time.Duration `env:"WEBHOOK_TIMEOUT" envDefault:"10s"`
+
+	OutboxPollInterval time.Duration `env:"OUTBOX_POLL_INTERVAL" envDefault:"1s"`
+	OutboxBatchSize    int           `env:"OUTBOX_BATCH_SIZE" envDefault:"100"`
+	OutboxFile         string        `env:"OUTBOX_FILE" envDefault:""`
 }
 
+// SetServerConfig loads the config from the command line of the process and exits when it
+// is invalid.
 func SetServerConfig() ServerConfig {
-	var envConfig ServerConfig
-	err := env.Parse(&envConfig)
+	config, err := Load(flag.CommandLine, os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
+	return config
+}
+
+// Load builds the config in layers: defaults, then the config file, then environment
+// variables, then flags of args. Secrets may be read from files named by <VAR>_FILE.
+// The config is validated; on a ValidationError it is returned as well.
+func Load(flags *flag.FlagSet, args []string) (ServerConfig, error) {
+	path := configFilePath(args)
+	config, err := loadEnvironment(path)
+	if err != nil {
+		return ServerConfig{}, err
+	}
 
-	var config ServerConfig
-	flag.StringVar(&config.Address, "a", envConfig.Address, "Address")
-	flag.StringVar(&config.DB, "d", envConfig.DB, "Address")
-	flag.StringVar(&config.AccrualSystem, "r", envConfig.AccrualSystem, "Address")
+	flags.StringVar(&config.ConfigFile, "config", path, "Config file, YAML, JSON or TOML by extension")
+	flags.StringVar(&config.Address, "a", config.Address, "Address")
+	flags.StringVar(&config.DB, "d", config.DB, "Database URI")
+	flags.StringVar(&config.AccrualSystem, "r", config.AccrualSystem, "Accrual system URL")
+	flags.BoolVar(&config.Migrate, "migrate", config.Migrate, "Create and upgrade the tables on start")
 
-	flag.DurationVar(&config.ContextCancel, "c", envConfig.ContextCancel, "Context cancel interval")
-	flag.DurationVar(&config.TokenDuration, "t", envConfig.TokenDuration, "Token duration")
-	flag.IntVar(&config.AccrualChannelPool, "p", envConfig.AccrualChannelPool, "Accrual channel pool size")
-	flag.StringVar(&config.HashKey, "k", envConfig.HashKey, "Hash key for passwords")
+	flags.DurationVar(&config.ContextCancel, "c", config.ContextCancel, "Context cancel interval")
+	flags.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "Graceful shutdown deadline")
+	flags.DurationVar(&config.ShutdownDrainDelay, "shutdown-drain-delay", config.ShutdownDrainDelay,
+		"How long requests are still served after readiness fails on shutdown")
+	flags.DurationVar(&config.TokenDuration, "t", config.TokenDuration, "Token duration")
+	flags.IntVar(&config.AccrualChannelPool, "p", config.AccrualChannelPool, "Accrual channel pool size")
+	flags.IntVar(&config.AccrualWorkers, "accrual-workers", config.AccrualWorkers, "Workers polling the accrual system")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "Log level: trace, debug, info, warn or error")
+	flags.DurationVar(&config.ConfigWatchInterval, "config-watch-interval", config.ConfigWatchInterval,
+		"How often the config file is checked for changes, 0 to turn off")
+	flags.StringVar(&config.HashKey, "k", config.HashKey, "Hash key for passwords")
+	flags.StringVar(&config.AccrualCallbackSecret, "accrual-callback-secret", config.AccrualCallbackSecret,
+		"Secret of the accrual push callback, enables push mode")
+	flags.DurationVar(&config.AccrualReconcile, "accrual-reconcile-interval", config.AccrualReconcile, "How often unfinished orders are checked")
+	flags.DurationVar(&config.AccrualReconcileAfter, "accrual-reconcile-after", config.AccrualReconcileAfter,
+		"Age of unfinished orders that are polled again")
+	flags.IntVar(&config.AccrualMaxAttempts, "accrual-max-attempts", config.AccrualMaxAttempts,
+		"Failed accrual polls before an order is dead-lettered")
+	flags.DurationVar(&config.AccrualBackoffBase, "accrual-backoff-base", config.AccrualBackoffBase, "First accrual retry delay")
+	flags.DurationVar(&config.AccrualBackoffMax, "accrual-backoff-max", config.AccrualBackoffMax, "Max accrual retry delay")
+	flags.DurationVar(&config.AccrualTimeout, "accrual-timeout", config.AccrualTimeout, "Accrual system request timeout")
+	flags.IntVar(&config.AccrualMaxIdleConns, "accrual-max-idle-conns", config.AccrualMaxIdleConns,
+		"Idle connections kept to the accrual system")
+	flags.IntVar(&config.AccrualBreakerErrors, "accrual-breaker-errors", config.AccrualBreakerErrors,
+		"Accrual system failures in a row that open the circuit breaker")
+	flags.DurationVar(&config.AccrualBreakerOpen, "accrual-breaker-open", config.AccrualBreakerOpen,
+		"How long the circuit breaker stays open before a probe")
+	flags.StringVar(&config.AccrualProviders, "accrual-providers", config.AccrualProviders,
+		"JSON array of additional accrual providers")
+	flags.DurationVar(&config.ReconcileInterval, "reconcile-interval", config.ReconcileInterval,
+		"How often processed orders are reconciled with the accrual system")
+	flags.DurationVar(&config.ReconcileWindow, "reconcile-window", config.ReconcileWindow, "How far back orders are reconciled")
+	flags.BoolVar(&config.ReconcileCorrect, "reconcile-correct", config.ReconcileCorrect, "Post adjustments for discrepancies")
+	flags.BoolVar(&config.ReconcileDryRun, "reconcile-dry-run", config.ReconcileDryRun, "Only report discrepancies")
+	flags.StringVar(&config.TracingExporter, "tracing-exporter", config.TracingExporter, "Trace exporter: none, stdout or otlp")
+	flags.StringVar(&config.TracingEndpoint, "tracing-endpoint", config.TracingEndpoint, "OTLP HTTP collector address")
+	flags.Float64Var(&config.TracingSampleRatio, "tracing-sample-ratio", config.TracingSampleRatio, "Share of traces recorded")
+	flags.StringVar(&config.RateLimits, "rate-limits", config.RateLimits, "Rate limits per route group, e.g. orders=60/1m")
+	flags.StringVar(&config.RateLimitStore, "rate-limit-store", config.RateLimitStore,
+		"Where rate limit counters are kept: memory or postgres")
+	flags.Int64Var(&config.DecompressLimit, "decompress-limit", config.DecompressLimit, "Max size of decompressed request body")
+	flags.IntVar(&config.CompressMinSize, "compress-min-size", config.CompressMinSize, "Min response size to compress")
+	flags.Int64Var(&config.BodyLimit, "body-limit", config.BodyLimit, "Max size of JSON request body")
+	flags.Int64Var(&config.OrderBodyLimit, "order-body-limit", config.OrderBodyLimit, "Max size of order upload body")
+	flags.Int64Var(&config.BatchBodyLimit, "batch-body-limit", config.BatchBodyLimit, "Max size of batch order upload body")
+	flags.IntVar(&config.BatchMaxOrders, "batch-max-orders", config.BatchMaxOrders, "Max order numbers in one batch")
+	flags.IntVar(&config.PasswordMinLength, "password-min-length", config.PasswordMinLength, "Min password length")
+	flags.DurationVar(&config.EventsHeartbeat, "events-heartbeat", config.EventsHeartbeat, "SSE heartbeat interval")
+	flags.IntVar(&config.EventsHistorySize, "events-history-size", config.EventsHistorySize, "Events kept per user for resume")
+	flags.DurationVar(&config.WebhookPollInterval, "webhook-poll-interval", config.WebhookPollInterval, "Webhook outbox poll interval")
+	flags.IntVar(&config.WebhookMaxAttempts, "webhook-max-attempts", config.WebhookMaxAttempts, "Webhook delivery attempts")
+	flags.DurationVar(&config.WebhookBackoffBase, "webhook-backoff-base", config.WebhookBackoffBase, "First webhook retry delay")
+	flags.DurationVar(&config.WebhookTimeout, "webhook-timeout", config.WebhookTimeout, "Webhook request timeout")
+	flags.DurationVar(&config.OutboxPollInterval, "outbox-poll-interval", config.OutboxPollInterval, "Outbox relay poll interval")
+	flags.IntVar(&config.OutboxBatchSize, "outbox-batch-size", config.OutboxBatchSize, "Outbox messages relayed at once")
+	flags.StringVar(&config.OutboxFile, "outbox-file", config.OutboxFile, "JSONL file the outbox is published to")
+	flags.BoolVar(&config.EventsPGNotify, "events-pg-notify", config.EventsPGNotify, "Fan out events through PostgreSQL LISTEN/NOTIFY")
 
-	/*err = env.Parse(&config)
-	if err != nil {
-		log.Fatal(err)
+	if err = flags.Parse(args); err != nil {
+		return ServerConfig{}, err
 	}
-	addr := flag.String("a", "127.0.0.1:8080", "Service address")
-	db := flag.String("d", "", "Database connection address")
-	accrualSystem := flag.String("r", "", "Accrual system address")
-	flag.Parse()
+	return config, config.Validate()
+}
+
+// LoadEnvironment reads the config file named by -config in args or CONFIG_FILE and the
+// environment, secret files included, like Load but without flags and validation. Tools
+// sharing the database and the hash key of the server read them with it.
+func LoadEnvironment(args []string) (ServerConfig, error) {
+	return loadEnvironment(configFilePath(args))
+}
 
-	if _, ok := os.LookupEnv("RUN_ADDRESS"); !ok {
-		config.Address = *addr
+func loadEnvironment(path string) (ServerConfig, error) {
+	environment, err := fileEnvironment(path)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	for _, entry := range os.Environ() {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			environment[key] = value
+		}
 	}
-	if _, ok := os.LookupEnv("DATABASE_URI"); !ok {
-		config.DB = *db
+	if err = readSecretFiles(environment); err != nil {
+		return ServerConfig{}, err
 	}
-	if _, ok := os.LookupEnv("ACCRUAL_SYSTEM_ADDRESS"); !ok {
-		config.AccrualSystem = *accrualSystem
-	}*/
 
-	return config
+	config := ServerConfig{ConfigFile: path}
+	if err = env.Parse(&config, env.Options{Environment: environment}); err != nil {
+		return ServerConfig{}, err
+	}
+	return config, nil
+}
+
+// configFilePath finds -config in args before they are parsed, because the file gives
+// the flags their defaults.
+func configFilePath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	return os.Getenv("CONFIG_FILE")
 }
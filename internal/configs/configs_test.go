@@ -0,0 +1,254 @@
+package configs
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets the variables of all settings for the test, so the environment of the
+// machine running it doesn't leak in.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, f := range fields() {
+		for _, name := range []string{f.env, f.env + secretFileSuffix} {
+			if _, ok := os.LookupEnv(name); ok {
+				// Setenv restores the value after the test
+				t.Setenv(name, "")
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func load(t *testing.T, args ...string) (ServerConfig, error) {
+	t.Helper()
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return Load(flags, args)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "config.yaml", "run_address: 127.0.0.1:9000\n"+
+		"accrual_system_address: http://file:8080\n"+
+		"log_level: warn\n"+
+		"database_uri: postgres://file/db\n")
+	t.Setenv("ACCRUAL_SYSTEM_ADDRESS", "http://env:8080")
+	t.Setenv("LOG_LEVEL", "info")
+
+	config, err := load(t, "-config", path, "-log-level", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]string{
+		"default": {config.TracingExporter, "none"},
+		"file":    {config.Address, "127.0.0.1:9000"},
+		"env":     {config.AccrualSystem, "http://env:8080"},
+		"flag":    {config.LogLevel, "error"},
+	}
+	for layer, values := range want {
+		if values[0] != values[1] {
+			t.Errorf("setting from %s = %q, want %q", layer, values[0], values[1])
+		}
+	}
+	if config.ConfigFile != path {
+		t.Errorf("ConfigFile = %q, want %q", config.ConfigFile, path)
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("CONFIG_FILE", writeFile(t, "config.json", `{"database_uri": "postgres://file/db"}`))
+	config, err := load(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DB != "postgres://file/db" {
+		t.Errorf("DB = %q, want the one of CONFIG_FILE", config.DB)
+	}
+}
+
+func TestLoadFileFormats(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": "database_uri: postgres://host/db\n" +
+			"ACCRUAL_WORKERS: 4\n" +
+			"reconcile_correct: true\n" +
+			"token_duration: 2h\n" +
+			"tracing_sample_ratio: 0.5\n" +
+			"accrual_providers:\n  - name: partner\n    address: http://partner\n",
+		"config.yml": "database_uri: postgres://host/db\n" +
+			"accrual_workers: 4\n" +
+			"reconcile_correct: true\n" +
+			"token_duration: 2h\n" +
+			"tracing_sample_ratio: 0.5\n" +
+			"accrual_providers: [{name: partner, address: http://partner}]\n",
+		"config.json": `{"database_uri": "postgres://host/db", "accrual_workers": 4, "reconcile_correct": true,
+			"token_duration": "2h", "tracing_sample_ratio": 0.5,
+			"accrual_providers": [{"name": "partner", "address": "http://partner"}]}`,
+		"config.toml": "database_uri = \"postgres://host/db\"\n" +
+			"accrual_workers = 4\n" +
+			"reconcile_correct = true\n" +
+			"token_duration = \"2h\"\n" +
+			"tracing_sample_ratio = 0.5\n" +
+			"[[accrual_providers]]\nname = \"partner\"\naddress = \"http://partner\"\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			clearEnv(t)
+			config, err := load(t, "-config", writeFile(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.DB != "postgres://host/db" || config.AccrualWorkers != 4 || !config.ReconcileCorrect ||
+				config.TokenDuration != 2*time.Hour || config.TracingSampleRatio != 0.5 {
+				t.Errorf("config = %+v", config)
+			}
+			if config.AccrualProviders != `[{"address":"http://partner","name":"partner"}]` {
+				t.Errorf("AccrualProviders = %s, want a JSON array", config.AccrualProviders)
+			}
+		})
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"config.yaml": "database_uri: postgres://host/db\nno_such_setting: 1\n",
+		"config.json": `{"database_uri": `,
+		"config.ini":  "database_uri = postgres://host/db\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			clearEnv(t)
+			if _, err := load(t, "-config", writeFile(t, name, content)); err == nil {
+				t.Error("Load accepted the file")
+			}
+		})
+	}
+	clearEnv(t)
+	if _, err := load(t, "-config", filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Load accepted a missing file")
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("DATABASE_URI", "postgres://host/db")
+	t.Setenv("HASH_KEY_FILE", writeFile(t, "hash_key", "s3cret\r\n\n"))
+	config, err := load(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.HashKey != "s3cret" {
+		t.Errorf("HashKey = %q, want the file content without trailing newlines", config.HashKey)
+	}
+
+	clearEnv(t)
+	t.Setenv("DATABASE_URI", "postgres://host/db")
+	t.Setenv("HASH_KEY", "inline")
+	t.Setenv("HASH_KEY_FILE", writeFile(t, "hash_key", "s3cret"))
+	if _, err = load(t); err == nil || !strings.Contains(err.Error(), "both HASH_KEY and HASH_KEY_FILE") {
+		t.Errorf("err = %v, want both HASH_KEY and HASH_KEY_FILE are set", err)
+	}
+
+	clearEnv(t)
+	t.Setenv("DATABASE_URI", "postgres://host/db")
+	t.Setenv("HASH_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err = load(t); err == nil {
+		t.Error("Load accepted a missing secret file")
+	}
+}
+
+func TestValidateCollectsAllProblems(t *testing.T) {
+	clearEnv(t)
+	_, err := load(t, "-a", "no-port", "-log-level", "loud", "-shutdown-timeout", "0s", "-rate-limits", "orders=many")
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("err = %v, want a ValidationError", err)
+	}
+	for _, setting := range []string{"RUN_ADDRESS", "DATABASE_URI", "LOG_LEVEL", "SHUTDOWN_TIMEOUT", "RATE_LIMITS"} {
+		found := false
+		for _, problem := range validationErr.Problems {
+			found = found || strings.HasPrefix(problem, setting)
+		}
+		if !found {
+			t.Errorf("no problem with %s in %q", setting, validationErr.Problems)
+		}
+	}
+	if len(validationErr.Problems) != 5 {
+		t.Errorf("problems = %q, want 5", validationErr.Problems)
+	}
+}
+
+func TestValidateDrainDelay(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("DATABASE_URI", "postgres://host/db")
+	for _, args := range [][]string{
+		{"-shutdown-timeout", "10s", "-shutdown-drain-delay", "10s"},
+		{"-shutdown-drain-delay", "-1s"},
+	} {
+		_, err := load(t, args...)
+		if err == nil || !strings.Contains(err.Error(), "SHUTDOWN_DRAIN_DELAY") {
+			t.Errorf("Load(%q): err = %v, want a SHUTDOWN_DRAIN_DELAY problem", args, err)
+		}
+	}
+	if _, err := load(t, "-shutdown-timeout", "10s", "-shutdown-drain-delay", "0s"); err != nil {
+		t.Errorf("no drain delay: %v", err)
+	}
+}
+
+func TestPrintLoadsBack(t *testing.T) {
+	for _, format := range []string{"yaml", "json", "toml"} {
+		t.Run(format, func(t *testing.T) {
+			clearEnv(t)
+			t.Setenv("DATABASE_URI", "postgres://gopher:pa55word@db:5432/mart?password=pa55word")
+			t.Setenv("HASH_KEY", "s3cret")
+			t.Setenv("ACCRUAL_PROVIDERS", `[{"address":"http://partner","name":"partner"}]`)
+			t.Setenv("ACCRUAL_WORKERS", "3")
+			config, err := load(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err = Print(&buf, config, format); err != nil {
+				t.Fatal(err)
+			}
+			for _, secret := range []string{"pa55word", "s3cret"} {
+				if strings.Contains(buf.String(), secret) {
+					t.Errorf("printed config has secret %s:\n%s", secret, buf.String())
+				}
+			}
+
+			clearEnv(t)
+			path := writeFile(t, "config."+format, buf.String())
+			loaded, err := load(t, "-config", path)
+			if err != nil {
+				t.Fatalf("printed config doesn't load: %v\n%s", err, buf.String())
+			}
+			want := config
+			want.ConfigFile = path
+			want.DB = "postgres://gopher:xxxxx@db:5432/mart"
+			want.HashKey = redacted
+			if !reflect.DeepEqual(loaded, want) {
+				t.Errorf("loaded config:\n%+v\nwant:\n%+v", loaded, want)
+			}
+		})
+	}
+}
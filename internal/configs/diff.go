@@ -0,0 +1,38 @@
+package configs
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Change is a setting that differs between two configs. Secrets are redacted.
+type Change struct {
+	Setting string
+	Old     string
+	New     string
+	// Reloadable settings are applied to the running service, others need a restart.
+	Reloadable bool
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %q -> %q", c.Setting, c.Old, c.New)
+}
+
+// Diff lists the settings changed from old to new, in the order of ServerConfig.
+func Diff(old ServerConfig, new ServerConfig) []Change {
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	var changes []Change
+	for _, f := range fields() {
+		from, to := oldValue.Field(f.index).Interface(), newValue.Field(f.index).Interface()
+		if reflect.DeepEqual(from, to) {
+			continue
+		}
+		change := Change{Setting: strings.ToLower(f.env), Old: fmt.Sprint(from), New: fmt.Sprint(to), Reloadable: f.reload}
+		if f.secret {
+			change.Old, change.New = redact(change.Old), redact(change.New)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
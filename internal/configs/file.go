@@ -0,0 +1,136 @@
+package configs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// secretFileSuffix names variables holding a path to a secret instead of the secret itself,
+// e.g. HASH_KEY_FILE=/run/secrets/hash_key.
+const secretFileSuffix = "_FILE"
+
+type field struct {
+	name   string
+	env    string
+	secret bool
+	reload bool
+	index  int
+}
+
+// fields lists the settings of ServerConfig with their variable names.
+func fields() []field {
+	t := reflect.TypeOf(ServerConfig{})
+	result := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("env"), ",")
+		if name == "" {
+			continue
+		}
+		result = append(result, field{name: f.Name, env: name, secret: f.Tag.Get("secret") == "true",
+			reload: f.Tag.Get("reload") == "true", index: i})
+	}
+	return result
+}
+
+// fileEnvironment reads the config file into variables, so it goes through the same parsing
+// as the environment. Keys are variable names in any case, e.g. run_address or RUN_ADDRESS.
+func fileEnvironment(path string) (map[string]string, error) {
+	environment := map[string]string{}
+	if path == "" {
+		return environment, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %w", err)
+	}
+
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("config file %s: unknown format, want .yaml, .yml, .json or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	known := map[string]bool{}
+	for _, f := range fields() {
+		known[f.env] = f.name != "ConfigFile"
+	}
+	var unknown []string
+	for key, value := range values {
+		name := strings.ToUpper(key)
+		if !known[name] {
+			unknown = append(unknown, key)
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		if environment[name], err = fileValue(value); err != nil {
+			return nil, fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("config file %s: unknown settings %s", path, strings.Join(unknown, ", "))
+	}
+	return environment, nil
+}
+
+// fileValue turns a value of the file into a variable. Lists and maps, e.g. accrual
+// providers, become JSON.
+func fileValue(value interface{}) (string, error) {
+	if v, ok := value.(string); ok {
+		return v, nil
+	}
+	// TOML decodes arrays of tables as []map[string]interface{}, so kinds are checked
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		data, err := json.Marshal(value)
+		return string(data), err
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
+
+// readSecretFiles sets secrets from files named by <VAR>_FILE. Trailing newlines are
+// dropped, editors and `echo` add them.
+func readSecretFiles(environment map[string]string) error {
+	for _, f := range fields() {
+		if !f.secret {
+			continue
+		}
+		path, ok := environment[f.env+secretFileSuffix]
+		if !ok {
+			continue
+		}
+		if _, ok = os.LookupEnv(f.env); ok {
+			return fmt.Errorf("both %s and %s are set", f.env, f.env+secretFileSuffix)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("couldn't read %s: %w", f.env+secretFileSuffix, err)
+		}
+		environment[f.env] = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
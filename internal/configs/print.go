@@ -0,0 +1,72 @@
+package configs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "******"
+
+// Print writes the config in a format accepted as a config file: yaml, json or toml.
+// Secrets are redacted, only the host part of a database URL is kept.
+func Print(w io.Writer, c ServerConfig, format string) error {
+	v := reflect.ValueOf(c)
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	values := map[string]interface{}{}
+	for _, f := range fields() {
+		// the file can't name itself, fileEnvironment rejects the key
+		if f.name == "ConfigFile" {
+			continue
+		}
+		key := strings.ToLower(f.env)
+		value := v.Field(f.index).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if f.secret {
+			value = redact(value.(string))
+		}
+		values[key] = value
+
+		valueNode := &yaml.Node{}
+		if err := valueNode.Encode(value); err != nil {
+			return err
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, valueNode)
+	}
+
+	switch format {
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		defer encoder.Close()
+		return encoder.Encode(node)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(values)
+	case "toml":
+		return toml.NewEncoder(w).Encode(values)
+	default:
+		return fmt.Errorf("unknown format %q, want yaml, json or toml", format)
+	}
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if u, err := url.Parse(secret); err == nil && u.Scheme != "" && u.Host != "" {
+		// the query may hold a password as well
+		u.RawQuery = ""
+		return u.Redacted()
+	}
+	return redacted
+}
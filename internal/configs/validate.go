@@ -0,0 +1,105 @@
+package configs
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/ratelimit"
+)
+
+// ValidationError lists all invalid settings of a config.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate reports all invalid settings at once in a ValidationError.
+func (c ServerConfig) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Address)
+	check(err == nil, "RUN_ADDRESS %q must be host:port", c.Address)
+	check(c.DB != "", "DATABASE_URI must be set")
+	check(validURL(c.AccrualSystem), "ACCRUAL_SYSTEM_ADDRESS %q must be an http or https URL", c.AccrualSystem)
+	check(c.HashKey != "", "HASH_KEY must be set")
+	_, err = zerolog.ParseLevel(c.LogLevel)
+	check(err == nil && c.LogLevel != "", "LOG_LEVEL %q is not a log level", c.LogLevel)
+	check(c.ConfigWatchInterval >= 0, "CONFIG_WATCH_INTERVAL must not be negative")
+
+	for name, d := range map[string]time.Duration{
+		"CANCEL_INTERVAL":            c.ContextCancel,
+		"SHUTDOWN_TIMEOUT":           c.ShutdownTimeout,
+		"TOKEN_DURATION":             c.TokenDuration,
+		"ACCRUAL_RECONCILE_INTERVAL": c.AccrualReconcile,
+		"ACCRUAL_BACKOFF_BASE":       c.AccrualBackoffBase,
+		"ACCRUAL_TIMEOUT":            c.AccrualTimeout,
+		"ACCRUAL_BREAKER_OPEN":       c.AccrualBreakerOpen,
+		"RECONCILE_INTERVAL":         c.ReconcileInterval,
+		"RECONCILE_WINDOW":           c.ReconcileWindow,
+		"EVENTS_HEARTBEAT":           c.EventsHeartbeat,
+		"WEBHOOK_POLL_INTERVAL":      c.WebhookPollInterval,
+		"WEBHOOK_BACKOFF_BASE":       c.WebhookBackoffBase,
+		"WEBHOOK_TIMEOUT":            c.WebhookTimeout,
+		"OUTBOX_POLL_INTERVAL":       c.OutboxPollInterval,
+	} {
+		check(d > 0, "%s must be positive", name)
+	}
+	// the timeout itself is reported above when it is not positive
+	check(c.ShutdownDrainDelay >= 0 && (c.ShutdownDrainDelay < c.ShutdownTimeout || c.ShutdownTimeout <= 0),
+		"SHUTDOWN_DRAIN_DELAY must not be negative and must be less than SHUTDOWN_TIMEOUT")
+	check(c.AccrualReconcileAfter >= 0, "ACCRUAL_RECONCILE_AFTER must not be negative")
+	check(c.AccrualBackoffMax >= c.AccrualBackoffBase, "ACCRUAL_BACKOFF_MAX must not be less than ACCRUAL_BACKOFF_BASE")
+
+	for name, n := range map[string]int64{
+		"ACCRUAL_CHANNEL_POOL":   int64(c.AccrualChannelPool),
+		"ACCRUAL_WORKERS":        int64(c.AccrualWorkers),
+		"ACCRUAL_MAX_ATTEMPTS":   int64(c.AccrualMaxAttempts),
+		"ACCRUAL_BREAKER_ERRORS": int64(c.AccrualBreakerErrors),
+		"DECOMPRESS_LIMIT":       c.DecompressLimit,
+		"BODY_LIMIT":             c.BodyLimit,
+		"ORDER_BODY_LIMIT":       c.OrderBodyLimit,
+		"BATCH_BODY_LIMIT":       c.BatchBodyLimit,
+		"BATCH_MAX_ORDERS":       int64(c.BatchMaxOrders),
+		"PASSWORD_MIN_LENGTH":    int64(c.PasswordMinLength),
+		"EVENTS_HISTORY_SIZE":    int64(c.EventsHistorySize),
+		"WEBHOOK_MAX_ATTEMPTS":   int64(c.WebhookMaxAttempts),
+		"OUTBOX_BATCH_SIZE":      int64(c.OutboxBatchSize),
+	} {
+		check(n > 0, "%s must be positive", name)
+	}
+	check(c.AccrualMaxIdleConns >= 0, "ACCRUAL_MAX_IDLE_CONNS must not be negative")
+	check(c.CompressMinSize >= 0, "COMPRESS_MIN_SIZE must not be negative")
+
+	_, err = ratelimit.ParseLimits(c.RateLimits)
+	check(err == nil, "RATE_LIMITS: %v", err)
+	check(c.RateLimitStore == "memory" || c.RateLimitStore == "postgres", "RATE_LIMIT_STORE must be memory or postgres")
+	check(c.TracingExporter == "none" || c.TracingExporter == "stdout" || c.TracingExporter == "otlp",
+		"TRACING_EXPORTER must be none, stdout or otlp")
+	check(c.TracingSampleRatio >= 0 && c.TracingSampleRatio <= 1, "TRACING_SAMPLE_RATIO must be between 0 and 1")
+
+	if len(problems) == 0 {
+		return nil
+	}
+	// map iteration makes the order random
+	sort.Strings(problems)
+	return &ValidationError{Problems: problems}
+}
+
+func validURL(address string) bool {
+	u, err := url.Parse(address)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
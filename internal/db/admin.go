@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgconn"
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+// Kinds of balance entries.
+const (
+	BalanceAccrual    = "accrual"
+	BalanceWithdrawal = "withdrawal"
+	BalancePromo      = "promo"
+	BalanceAdjustment = "adjustment"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+// SearchUsers returns users whose login contains search, all users when it is empty,
+// ordered by ID and starting after afterID.
+func (db *DBStorage) SearchUsers(ctx context.Context, search string, afterID int64, limit int) ([]entity.UserSummary, error) {
+	var users []entity.UserSummary
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT u.id, u.login, u.is_admin, "+
+		"COALESCE(b.current, 0), COALESCE(b.withdrawn, 0), "+
+		"(SELECT count(*) FROM Orders o WHERE o.user_id = u.id) "+
+		"FROM Users u LEFT JOIN Balances b ON b.user_id = u.id "+
+		"WHERE u.id > $1 AND strpos(lower(u.login), lower($2)) > 0 ORDER BY u.id LIMIT $3", afterID, search, limit)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user entity.UserSummary
+		if err = rows.Scan(&user.ID, &user.Login, &user.IsAdmin, &user.Current, &user.Withdrawn, &user.Orders); err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		users = append(users, user)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return users, nil
+}
+
+// GetBalanceHistory returns the latest changes of the user balance, newest first.
+func (db *DBStorage) GetBalanceHistory(ctx context.Context, userID int64, limit int) ([]entity.BalanceEntry, error) {
+	var entries []entity.BalanceEntry
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT kind, reference, amount, at FROM ("+
+		"SELECT $2::text AS kind, o.id AS reference, o.accrual AS amount, "+
+		"(SELECT max(h.changed_at) FROM Order_status_history h WHERE h.order_id = o.id AND h.status = $6) AS at "+
+		"FROM Orders o WHERE o.user_id = $1 AND o.status = $6 AND o.accrual > 0 "+
+		"UNION ALL SELECT $3::text, w.order_id, -w.sum, w.processed_at FROM Withdrawals w WHERE w.user_id = $1 "+
+		"UNION ALL SELECT $4::text, r.code, p.points, r.redeemed_at FROM Promo_redemptions r "+
+		"JOIN Promos p ON p.code = r.code WHERE r.user_id = $1 "+
+		"UNION ALL SELECT $5::text, COALESCE(a.order_id, a.reason), a.amount, a.created_at FROM Balance_adjustments a WHERE a.user_id = $1"+
+		") entries ORDER BY at DESC NULLS LAST LIMIT $7",
+		userID, BalanceAccrual, BalanceWithdrawal, BalancePromo, BalanceAdjustment, processedStatus, limit)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry entity.BalanceEntry
+		var at sql.NullTime
+		if err = rows.Scan(&entry.Kind, &entry.Reference, &entry.Amount, &at); err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		entry.At = at.Time
+		entries = append(entries, entry)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return entries, nil
+}
+
+// GetAdjustments returns the balance adjustments of the user, oldest first.
+func (db *DBStorage) GetAdjustments(ctx context.Context, userID int64) ([]entity.BalanceAdjustment, error) {
+	var adjustments []entity.BalanceAdjustment
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT id, user_id, COALESCE(order_id, ''), amount, reason, created_at "+
+		"FROM Balance_adjustments WHERE user_id=$1 ORDER BY id", userID)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var adjustment entity.BalanceAdjustment
+		err = rows.Scan(&adjustment.ID, &adjustment.UserID, &adjustment.OrderID, &adjustment.Amount, &adjustment.Reason,
+			&adjustment.CreatedAt)
+		if err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		adjustments = append(adjustments, adjustment)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return adjustments, nil
+}
+
+// AddAdmin creates an admin user with an empty balance. The password must be hashed.
+func (db *DBStorage) AddAdmin(ctx context.Context, login string, password string) (int64, error) {
+	var id int64
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, "INSERT INTO Users (login, password, is_admin) VALUES ($1, $2, true) RETURNING id",
+			login, password).Scan(&id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO Balances (user_id) VALUES ($1)", id)
+		return err
+	})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return 0, ErrLoginExists
+	}
+	if err != nil {
+		return 0, &ErrorDB{Err: err}
+	}
+	log.Ctx(ctx).Info().Msgf("Add admin %s\n", login)
+	return id, nil
+}
+
+// SetAdmin grants or revokes admin access of an existing user.
+func (db *DBStorage) SetAdmin(ctx context.Context, login string, isAdmin bool) error {
+	res, err := db.dbConnection.ExecContext(ctx, "UPDATE Users SET is_admin=$1 WHERE login=$2", isAdmin, login)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	log.Ctx(ctx).Info().Msgf("Set admin of %s to %t\n", login, isAdmin)
+	return nil
+}
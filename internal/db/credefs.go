@@ -1,26 +1,39 @@
 package db
 
-import "context"
+import (
+	"context"
+	"database/sql"
+)
 
 func (db *DBStorage) CreateUsers(ctx context.Context) {
 	query := "CREATE TABLE IF NOT EXISTS Users (" +
 		"id SERIAL PRIMARY KEY," +
 		"login varchar(50) NOT NULL," +
 		"password varchar(250) NOT NULL," +
+		"is_admin boolean DEFAULT false," +
 		"CONSTRAINT unique_login UNIQUE(login));"
 	_, err := db.dbConnection.ExecContext(ctx, query)
 	if err != nil {
 		panic(err)
 	}
+	_, err = db.dbConnection.ExecContext(ctx, "ALTER TABLE Users ADD COLUMN IF NOT EXISTS is_admin boolean DEFAULT false;")
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (db *DBStorage) CreateOrders(ctx context.Context) {
 	query := "CREATE TABLE IF NOT EXISTS Orders (" +
-		"id varchar(50) NOT NULL," +
+		"id text NOT NULL," +
 		"user_id bigint NOT NULL," +
 		"status varchar(50)," +
 		"accrual real," +
 		"uploaded_at timestamp DEFAULT current_timestamp," +
+		"partner varchar(50)," +
+		"attempts int DEFAULT 0," +
+		"last_error text," +
+		"provider varchar(50)," +
+		"trace_parent varchar(55)," +
 		"PRIMARY KEY(id)," +
 		"CONSTRAINT fk_user " +
 		"FOREIGN KEY(user_id) " +
@@ -29,6 +42,30 @@ func (db *DBStorage) CreateOrders(ctx context.Context) {
 	if err != nil {
 		panic(err)
 	}
+	_, err = db.dbConnection.ExecContext(ctx, "ALTER TABLE Orders ADD COLUMN IF NOT EXISTS partner varchar(50);")
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.dbConnection.ExecContext(ctx, "ALTER TABLE Orders ADD COLUMN IF NOT EXISTS attempts int DEFAULT 0, "+
+		"ADD COLUMN IF NOT EXISTS last_error text, ADD COLUMN IF NOT EXISTS provider varchar(50), "+
+		"ADD COLUMN IF NOT EXISTS trace_parent varchar(55);")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (db *DBStorage) CreateOrderStatusHistory(ctx context.Context) {
+	query := "CREATE TABLE IF NOT EXISTS Order_status_history (" +
+		"id SERIAL PRIMARY KEY," +
+		"order_id text NOT NULL," +
+		"status varchar(50) NOT NULL," +
+		"accrual real," +
+		"changed_at timestamp DEFAULT clock_timestamp()," +
+		"CONSTRAINT fk_order FOREIGN KEY(order_id) REFERENCES Orders(id) ON DELETE CASCADE);"
+	_, err := db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (db *DBStorage) CreateBalance(ctx context.Context) {
@@ -48,10 +85,211 @@ func (db *DBStorage) CreateWithdrawals(ctx context.Context) {
 		"user_id bigint NOT NULL," +
 		"sum real," +
 		"processed_at timestamp DEFAULT current_timestamp," +
-		"order_id varchar(50) NOT NULL," +
+		"order_id text NOT NULL," +
+		"CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES Users(id) ON DELETE CASCADE);"
+	_, err := db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (db *DBStorage) CreatePromos(ctx context.Context) {
+	query := "CREATE TABLE IF NOT EXISTS Promos (" +
+		"code varchar(50) NOT NULL," +
+		"points real NOT NULL," +
+		"mode varchar(10) NOT NULL," +
+		"total_limit int DEFAULT 0," +
+		"per_user_limit int DEFAULT 0," +
+		"valid_from timestamp," +
+		"valid_until timestamp," +
+		"redeemed int DEFAULT 0," +
+		"PRIMARY KEY(code));"
+	_, err := db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+	query = "CREATE TABLE IF NOT EXISTS Promo_redemptions (" +
+		"code varchar(50) NOT NULL," +
+		"user_id bigint NOT NULL," +
+		"redeemed_at timestamp DEFAULT current_timestamp," +
+		"CONSTRAINT fk_promo FOREIGN KEY(code) REFERENCES Promos(code) ON DELETE CASCADE," +
+		"CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES Users(id) ON DELETE CASCADE);"
+	_, err = db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (db *DBStorage) CreateWebhooks(ctx context.Context) {
+	query := "CREATE TABLE IF NOT EXISTS Webhooks (" +
+		"id SERIAL PRIMARY KEY," +
+		"user_id bigint," +
+		"partner varchar(50)," +
+		"url varchar(2000) NOT NULL," +
+		"secret varchar(100) NOT NULL," +
+		"events varchar(200) NOT NULL," +
+		"created_at timestamp DEFAULT current_timestamp," +
+		"CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES Users(id) ON DELETE CASCADE);"
+	_, err := db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+	query = "CREATE TABLE IF NOT EXISTS Webhook_deliveries (" +
+		"id BIGSERIAL PRIMARY KEY," +
+		"webhook_id int NOT NULL," +
+		"event varchar(50) NOT NULL," +
+		"payload text NOT NULL," +
+		"status varchar(20) DEFAULT 'pending'," +
+		"attempts int DEFAULT 0," +
+		"next_attempt_at timestamp DEFAULT current_timestamp," +
+		"last_error text," +
+		"response_code int," +
+		"created_at timestamp DEFAULT current_timestamp," +
+		"delivered_at timestamp," +
+		"CONSTRAINT fk_webhook FOREIGN KEY(webhook_id) REFERENCES Webhooks(id) ON DELETE CASCADE);"
+	_, err = db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.dbConnection.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS webhook_deliveries_pending "+
+		"ON Webhook_deliveries (next_attempt_at) WHERE status = 'pending';")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// CreatePartners keeps the API keys partner shops authenticate with. Only hashes of the
+// keys are stored.
+func (db *DBStorage) CreatePartners(ctx context.Context) {
+	query := "CREATE TABLE IF NOT EXISTS Partners (" +
+		"name varchar(50) PRIMARY KEY," +
+		"key_hash varchar(100) NOT NULL," +
+		"created_at timestamp DEFAULT current_timestamp," +
+		"CONSTRAINT unique_partner_key UNIQUE(key_hash));"
+	_, err := db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (db *DBStorage) CreateOutbox(ctx context.Context) {
+	query := "CREATE TABLE IF NOT EXISTS Outbox (" +
+		"id BIGSERIAL PRIMARY KEY," +
+		"user_id bigint NOT NULL," +
+		"event_type varchar(50) NOT NULL," +
+		"payload text NOT NULL," +
+		"created_at timestamp DEFAULT current_timestamp," +
+		"published_at timestamp);"
+	_, err := db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.dbConnection.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS outbox_unpublished ON Outbox (id) WHERE published_at IS NULL;")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (db *DBStorage) CreateReconciliation(ctx context.Context) {
+	query := "CREATE TABLE IF NOT EXISTS Balance_adjustments (" +
+		"id BIGSERIAL PRIMARY KEY," +
+		"user_id bigint NOT NULL," +
+		"order_id text," +
+		"amount real NOT NULL," +
+		"reason text NOT NULL," +
+		"created_at timestamp DEFAULT current_timestamp," +
 		"CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES Users(id) ON DELETE CASCADE);"
 	_, err := db.dbConnection.ExecContext(ctx, query)
 	if err != nil {
 		panic(err)
 	}
+	query = "CREATE TABLE IF NOT EXISTS Accrual_discrepancies (" +
+		"id BIGSERIAL PRIMARY KEY," +
+		"order_id text NOT NULL," +
+		"user_id bigint NOT NULL," +
+		"status varchar(50) NOT NULL," +
+		"accrual real NOT NULL," +
+		"actual_status varchar(50) NOT NULL," +
+		"actual_accrual real NOT NULL," +
+		"detected_at timestamp DEFAULT current_timestamp," +
+		"adjustment_id bigint," +
+		"CONSTRAINT fk_order FOREIGN KEY(order_id) REFERENCES Orders(id) ON DELETE CASCADE," +
+		"CONSTRAINT fk_adjustment FOREIGN KEY(adjustment_id) REFERENCES Balance_adjustments(id));"
+	_, err = db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+	// one open discrepancy per order, repeated runs update it
+	_, err = db.dbConnection.ExecContext(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS accrual_discrepancies_open "+
+		"ON Accrual_discrepancies (order_id) WHERE adjustment_id IS NULL;")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// CreateRateLimits keeps one fixed-window counter per rate limit key, shared by all instances.
+func (db *DBStorage) CreateRateLimits(ctx context.Context) {
+	query := "CREATE TABLE IF NOT EXISTS Rate_limits (" +
+		"key varchar(200) PRIMARY KEY," +
+		"window_start timestamptz NOT NULL," +
+		"count int NOT NULL);"
+	_, err := db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// SchemaVersion is increased with every change of the tables in this file.
+const SchemaVersion = 15
+
+// migrations change existing tables in ways that lock them, so each runs once, when a
+// database older than its version is upgraded. The Create functions already define fresh
+// tables the new way.
+var migrations = []struct {
+	version int
+	queries []string
+}{
+	// order numbers may be of any length, older databases have varchar(50) there
+	{15, []string{
+		"ALTER TABLE Orders ALTER COLUMN id TYPE text;",
+		"ALTER TABLE Order_status_history ALTER COLUMN order_id TYPE text;",
+		"ALTER TABLE Withdrawals ALTER COLUMN order_id TYPE text;",
+		"ALTER TABLE Balance_adjustments ALTER COLUMN order_id TYPE text;",
+		"ALTER TABLE Accrual_discrepancies ALTER COLUMN order_id TYPE text;",
+	}},
+}
+
+// migrate runs the migrations newer than the schema version from.
+func (db *DBStorage) migrate(ctx context.Context, from int) {
+	for _, migration := range migrations {
+		if migration.version <= from {
+			continue
+		}
+		err := db.withTx(ctx, func(tx *sql.Tx) error {
+			for _, query := range migration.queries {
+				if _, err := tx.ExecContext(ctx, query); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (db *DBStorage) CreateSchemaVersion(ctx context.Context) {
+	query := "CREATE TABLE IF NOT EXISTS Schema_version (" +
+		"version int NOT NULL," +
+		"applied_at timestamp DEFAULT current_timestamp);"
+	_, err := db.dbConnection.ExecContext(ctx, query)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.dbConnection.ExecContext(ctx, "INSERT INTO Schema_version (version) SELECT $1::int "+
+		"WHERE NOT EXISTS (SELECT 1 FROM Schema_version WHERE version >= $1::int);", SchemaVersion)
+	if err != nil {
+		panic(err)
+	}
 }
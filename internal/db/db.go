@@ -3,17 +3,43 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+	"github.com/fortuna91/ya_praktikum_final/internal/tracing"
+	"github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4/stdlib"
+	"strings"
+	"time"
 
+	"github.com/XSAM/otelsql"
 	"github.com/rs/zerolog/log"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 )
 
 type DBStorage struct {
 	dbConnection *sql.DB
 }
 
+const uniqueViolation = "23505"
+const undefinedTable = "42P01"
+
+const (
+	newStatus       = "NEW"
+	processedStatus = "PROCESSED"
+	invalidStatus   = "INVALID"
+	// FailedStatus is the dead-letter status of orders the accrual system couldn't
+	// calculate within the retry budget.
+	FailedStatus = "FAILED"
+)
+
+var (
+	ErrLoginExists       = errors.New("login already exists")
+	ErrInsufficientFunds = errors.New("not enough balance")
+	ErrOrderNotFound     = errors.New("order not found")
+	ErrOrderNotFailed    = errors.New("order is not dead-lettered")
+)
+
 type ErrorDB struct {
 	Err error
 }
@@ -23,7 +49,8 @@ func (err *ErrorDB) Error() string {
 }
 
 func New(dbAddress string) (*DBStorage, error) {
-	dbConn, err := sql.Open("pgx", dbAddress)
+	// every query gets a span in the trace of its context
+	dbConn, err := otelsql.Open("pgx", dbAddress, otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
 	if err != nil {
 		return nil, &ErrorDB{Err: err}
 	}
@@ -33,22 +60,78 @@ func New(dbAddress string) (*DBStorage, error) {
 }
 
 func (db *DBStorage) Create(ctx context.Context) {
+	// taken before the tables are created, it is 0 for fresh databases and for those
+	// older than Schema_version
+	version, err := db.GetSchemaVersion(ctx)
+	if err != nil {
+		panic(err)
+	}
 	db.CreateUsers(ctx)
 	db.CreateBalance(ctx)
 	db.CreateOrders(ctx)
+	db.CreateOrderStatusHistory(ctx)
 	db.CreateWithdrawals(ctx)
+	db.CreatePromos(ctx)
+	db.CreateWebhooks(ctx)
+	db.CreatePartners(ctx)
+	db.CreateOutbox(ctx)
+	db.CreateReconciliation(ctx)
+	db.CreateRateLimits(ctx)
+	db.migrate(ctx, version)
+	db.CreateSchemaVersion(ctx)
+}
+
+func (db *DBStorage) Ping(ctx context.Context) error {
+	return db.dbConnection.PingContext(ctx)
+}
+
+// GetSchemaVersion returns the latest schema version applied to the database, 0 if no
+// schema has been created yet.
+func (db *DBStorage) GetSchemaVersion(ctx context.Context) (int, error) {
+	var version sql.NullInt64
+	err := db.dbConnection.QueryRowContext(ctx, "SELECT max(version) FROM Schema_version").Scan(&version)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == undefinedTable {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, &ErrorDB{Err: err}
+	}
+	return int(version.Int64), nil
+}
+
+// DB returns the connection pool, e.g. to export its stats.
+func (db *DBStorage) DB() *sql.DB {
+	return db.dbConnection
 }
 
 func (db *DBStorage) Close() {
 	db.dbConnection.Close()
 }
 
+// withTx runs fn inside a transaction and commits it if fn returns no error.
+func (db *DBStorage) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.dbConnection.BeginTx(ctx, nil)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return &ErrorDB{Err: err}
+	}
+	return nil
+}
+
 func (db *DBStorage) GetUser(ctx context.Context, login string) *entity.User {
 	user := entity.User{}
 
-	err := db.dbConnection.QueryRowContext(ctx, "SELECT * FROM Users WHERE login=$1", login).Scan(&user.ID, &user.Login, &user.Password)
+	err := db.dbConnection.QueryRowContext(ctx, "SELECT id, login, password, is_admin FROM Users WHERE login=$1", login).
+		Scan(&user.ID, &user.Login, &user.Password, &user.IsAdmin)
 	if err != nil {
-		log.Warn().Msgf("User with login %s doesn't exist. %s\n", login, err)
+		log.Ctx(ctx).Warn().Msgf("User with login %s doesn't exist. %s\n", login, err)
 		return nil
 	}
 	return &user
@@ -57,82 +140,418 @@ func (db *DBStorage) GetUser(ctx context.Context, login string) *entity.User {
 func (db *DBStorage) AddUser(ctx context.Context, login string, password string) error {
 	_, err := db.dbConnection.ExecContext(ctx, "INSERT INTO Users (login, password) VALUES ($1, $2);",
 		login, password)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrLoginExists
+	}
 	if err != nil {
 		return &ErrorDB{Err: fmt.Errorf("couldn't add user %s into DB: %s", login, err)}
 	}
 	return nil
 }
 
-func (db *DBStorage) GetOrder(ctx context.Context, orderID string) *entity.Order {
+const orderColumns = "id, user_id, status, accrual, uploaded_at, partner, provider, trace_parent"
+
+func scanOrder(row rowScanner) (*entity.Order, error) {
 	order := entity.Order{}
 	var status sql.NullString
 	var accrual sql.NullFloat64
+	var partner sql.NullString
+	var provider sql.NullString
+	var traceParent sql.NullString
 
-	err := db.dbConnection.QueryRowContext(ctx, "SELECT * FROM Orders WHERE id=$1", orderID).
-		Scan(&order.ID, &order.UserID, &status, &accrual, &order.UploadedAt)
+	err := row.Scan(&order.ID, &order.UserID, &status, &accrual, &order.UploadedAt, &partner, &provider, &traceParent)
 	if err != nil {
-		log.Warn().Msgf("Order %s doesn't exist. %s\n", orderID, err)
-		return nil
+		return nil, err
 	}
+	order.Partner = partner.String
+	order.Provider = provider.String
+	order.TraceParent = traceParent.String
 	if status.Valid {
 		order.Status = status.String
 	}
 	if accrual.Valid {
 		order.Accrual = float32(accrual.Float64)
 	}
-	return &order
+	return &order, nil
+}
+
+func (db *DBStorage) GetOrder(ctx context.Context, orderID string) *entity.Order {
+	order, err := scanOrder(db.dbConnection.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM Orders WHERE id=$1", orderID))
+	if err != nil {
+		log.Ctx(ctx).Warn().Msgf("Order %s doesn't exist. %s\n", orderID, err)
+		return nil
+	}
+	return order
 }
 
-func (db *DBStorage) AddOrder(ctx context.Context, id string, userID int64, status string) error {
-	_, err := db.dbConnection.ExecContext(ctx, "INSERT INTO Orders (id, user_id, status) VALUES ($1, $2, $3);",
-		id, userID, status)
+func (db *DBStorage) AddOrder(ctx context.Context, id string, userID int64, status string, partner string) error {
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		// the trace of the upload is kept, so the accrual work can be linked back to it
+		if _, err := tx.ExecContext(ctx, "INSERT INTO Orders (id, user_id, status, partner, trace_parent) "+
+			"VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''));", id, userID, status, partner, tracing.TraceParent(ctx)); err != nil {
+			return err
+		}
+		if err := addOrderStatus(ctx, tx, id, status, 0); err != nil {
+			return err
+		}
+		return addOutboxEvent(ctx, tx, userID, entity.OutboxOrderAdded, entity.Order{ID: id, Status: status})
+	})
 	if err != nil {
 		return &ErrorDB{Err: fmt.Errorf("couldn't add order %s into DB: %s", id, err)}
 	}
-	log.Info().Msgf("Add order %s\n", id)
+	log.Ctx(ctx).Info().Msgf("Add order %s\n", id)
 	return nil
 }
 
-func (db *DBStorage) UpdateOrder(ctx context.Context, id string, userID int64, status string, accrual float32) error {
-	_, err := db.dbConnection.ExecContext(ctx, "INSERT INTO Orders (id, user_id, status, accrual) VALUES ($1, $2, $3, $4)"+
-		"ON CONFLICT (id) DO UPDATE SET status = excluded.status, accrual = excluded.accrual;",
-		id, userID, status, accrual)
+// ApplyAccrual saves the accrual system result for the order and credits the balance in one
+// transaction. Orders in a final status are never changed again, so a result that comes
+// both by polling and by push is credited once. It returns the updated order, or nil when
+// nothing has changed.
+func (db *DBStorage) ApplyAccrual(ctx context.Context, id string, provider string, status string, accrual float32) (*entity.Order, error) {
+	var order *entity.Order
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		current, err := scanOrder(tx.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM Orders WHERE id=$1 FOR UPDATE", id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if IsFinalStatus(current.Status) || (current.Status == status && current.Accrual == accrual) {
+			return nil
+		}
+		if status != processedStatus {
+			accrual = 0
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Orders SET status=$2, accrual=$3, provider=$4, attempts=0, last_error=NULL "+
+			"WHERE id=$1", id, status, accrual, provider); err != nil {
+			return err
+		}
+		if err = addOrderStatus(ctx, tx, id, status, accrual); err != nil {
+			return err
+		}
+		current.Status, current.Accrual, current.Provider = status, accrual, provider
+		order = current
+		if status != processedStatus {
+			return nil
+		}
+		if err = addOutboxEvent(ctx, tx, current.UserID, entity.OutboxOrderProcessed, current); err != nil {
+			return err
+		}
+		if err = addWebhookDeliveries(ctx, tx, entity.WebhookOrderProcessed, current.UserID, current.Partner,
+			entity.Order{ID: id, Status: status, Accrual: accrual}); err != nil {
+			return err
+		}
+		if accrual == 0 {
+			return nil
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Balances SET current = current + $1 WHERE user_id=$2",
+			accrual, current.UserID); err != nil {
+			return err
+		}
+		return addOutboxEvent(ctx, tx, current.UserID, entity.OutboxBalanceCredited,
+			entity.BalanceCredit{Sum: accrual, OrderID: id})
+	})
+	if errors.Is(err, ErrOrderNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &ErrorDB{Err: fmt.Errorf("couldn't apply accrual to order %s: %s", id, err)}
+	}
+	if order != nil {
+		log.Ctx(ctx).Info().Msgf("Update order %s: %s, accrual %f\n", id, status, accrual)
+	}
+	return order, nil
+}
+
+// FailAccrualAttempt records a failed attempt to get the accrual of the order and returns
+// the number of failed attempts in a row. After maxAttempts the order is moved to
+// FailedStatus and the returned order is set.
+func (db *DBStorage) FailAccrualAttempt(ctx context.Context, id string, lastError string, maxAttempts int) (int, *entity.Order, error) {
+	var attempts int
+	var order *entity.Order
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		var userID int64
+		err := tx.QueryRowContext(ctx, "UPDATE Orders SET attempts = attempts + 1, last_error=$2 "+
+			"WHERE id=$1 AND status <> ALL($3::varchar[]) RETURNING attempts, user_id",
+			id, lastError, []string{processedStatus, invalidStatus, FailedStatus}).Scan(&attempts, &userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// the order has got a result or has been dead-lettered meanwhile
+			return nil
+		}
+		if err != nil || attempts < maxAttempts {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Orders SET status=$2 WHERE id=$1", id, FailedStatus); err != nil {
+			return err
+		}
+		if err = addOrderStatus(ctx, tx, id, FailedStatus, 0); err != nil {
+			return err
+		}
+		order = &entity.Order{ID: id, UserID: userID, Status: FailedStatus}
+		return addOutboxEvent(ctx, tx, userID, entity.OutboxOrderFailed, entity.FailedOrder{Number: id, UserID: userID,
+			Attempts: attempts, LastError: lastError})
+	})
 	if err != nil {
-		return &ErrorDB{Err: fmt.Errorf("couldn't update order %s into DB: %s", id, err)}
+		return 0, nil, &ErrorDB{Err: fmt.Errorf("couldn't save accrual failure of order %s: %s", id, err)}
 	}
-	log.Info().Msgf("Update order %s\n", id)
-	return nil
+	if order != nil {
+		log.Ctx(ctx).Warn().Msgf("Order %s is dead-lettered after %d attempts: %s\n", id, attempts, lastError)
+	}
+	return attempts, order, nil
 }
 
-func (db *DBStorage) GetOrders(ctx context.Context, userID int64) ([]entity.Order, error) {
-	var orders []entity.Order
-	var status sql.NullString
-	var accrual sql.NullFloat64
+// GetFailedOrders returns dead-lettered orders, the most recently uploaded first.
+func (db *DBStorage) GetFailedOrders(ctx context.Context, limit int) ([]entity.FailedOrder, error) {
+	var orders []entity.FailedOrder
 
-	rows, err := db.dbConnection.QueryContext(ctx, "SELECT * FROM Orders WHERE user_id=$1 ORDER BY uploaded_at", userID)
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT id, user_id, attempts, last_error, uploaded_at FROM Orders "+
+		"WHERE status=$1 ORDER BY uploaded_at DESC LIMIT $2", FailedStatus, limit)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		order := entity.FailedOrder{}
+		var lastError sql.NullString
+		if err = rows.Scan(&order.Number, &order.UserID, &order.Attempts, &lastError, &order.UploadedAt); err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		order.LastError = lastError.String
+		orders = append(orders, order)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return orders, nil
+}
+
+// RequeueOrder takes the order out of the dead-letter status with a fresh retry budget.
+func (db *DBStorage) RequeueOrder(ctx context.Context, id string) (*entity.Order, error) {
+	var order *entity.Order
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		current, err := scanOrder(tx.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM Orders WHERE id=$1 FOR UPDATE", id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if current.Status != FailedStatus {
+			return ErrOrderNotFailed
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Orders SET status=$2, attempts=0, last_error=NULL WHERE id=$1",
+			id, newStatus); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if err = addOrderStatus(ctx, tx, id, newStatus, 0); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		current.Status = newStatus
+		order = current
+		return nil
+	})
 	if err != nil {
-		log.Error().Msgf("Couldn't read orders for user. %s\n", err)
 		return nil, err
 	}
+	log.Ctx(ctx).Info().Msgf("Requeue order %s\n", id)
+	return order, nil
+}
+
+// IsFinalStatus reports whether the accrual system won't change the order any more.
+func IsFinalStatus(status string) bool {
+	return status == processedStatus || status == invalidStatus
+}
+
+// GetUnfinishedOrders returns orders still waiting for the accrual system that were
+// uploaded earlier than olderThan ago, oldest first.
+func (db *DBStorage) GetUnfinishedOrders(ctx context.Context, olderThan time.Duration, limit int) ([]entity.Order, error) {
+	var orders []entity.Order
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT "+orderColumns+" FROM Orders WHERE status <> ALL($1::varchar[]) "+
+		"AND uploaded_at <= current_timestamp - $2::double precision * interval '1 millisecond' ORDER BY uploaded_at LIMIT $3",
+		[]string{processedStatus, invalidStatus, FailedStatus}, olderThan.Milliseconds(), limit)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
 
 	for rows.Next() {
-		order := entity.Order{}
-		err = rows.Scan(&order.ID, &order.UserID, &status, &accrual, &order.UploadedAt)
+		order, err := scanOrder(rows)
 		if err != nil {
-			log.Error().Msgf("Couldn't set order %s from DB: %s\n", order.ID, err)
 			return nil, &ErrorDB{Err: err}
 		}
-		if status.Valid {
-			order.Status = status.String
+		orders = append(orders, *order)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return orders, nil
+}
+
+// AddOrders inserts all new orders of the batch in one transaction and reports a status
+// for every number: accepted, already added by the user or owned by another user.
+func (db *DBStorage) AddOrders(ctx context.Context, ids []string, userID int64, status string, partner string) (map[string]string, error) {
+	results := make(map[string]string, len(ids))
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "INSERT INTO Orders (id, user_id, status, partner, trace_parent) "+
+			"SELECT unnest($1::varchar[]), $2, $3, NULLIF($4, ''), NULLIF($5, '') "+
+			"ON CONFLICT (id) DO NOTHING RETURNING id", ids, userID, status, partner, tracing.TraceParent(ctx))
+		if err != nil {
+			return err
+		}
+		var accepted []string
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			accepted = append(accepted, id)
+			results[id] = entity.BatchAccepted
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+		if len(accepted) > 0 {
+			if _, err = tx.ExecContext(ctx, "INSERT INTO Order_status_history (order_id, status, accrual) "+
+				"SELECT unnest($1::varchar[]), $2, 0", accepted, status); err != nil {
+				return err
+			}
+		}
+		for _, id := range accepted {
+			if err = addOutboxEvent(ctx, tx, userID, entity.OutboxOrderAdded, entity.Order{ID: id, Status: status}); err != nil {
+				return err
+			}
+		}
+
+		if len(accepted) == len(ids) {
+			return nil
+		}
+		rows, err = tx.QueryContext(ctx, "SELECT id, user_id FROM Orders WHERE id = ANY($1::varchar[])", ids)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			var owner int64
+			if err = rows.Scan(&id, &owner); err != nil {
+				return err
+			}
+			if _, ok := results[id]; ok {
+				continue
+			}
+			if owner == userID {
+				results[id] = entity.BatchAlreadyYours
+			} else {
+				results[id] = entity.BatchAnotherUser
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, &ErrorDB{Err: fmt.Errorf("couldn't add orders into DB: %s", err)}
+	}
+	log.Ctx(ctx).Info().Msgf("Add orders batch of %d for user %d\n", len(ids), userID)
+	return results, nil
+}
+
+func addOrderStatus(ctx context.Context, tx *sql.Tx, id string, status string, accrual float32) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO Order_status_history (order_id, status, accrual) VALUES ($1, $2, $3);",
+		id, status, accrual)
+	return err
+}
+
+func (db *DBStorage) GetOrderHistory(ctx context.Context, orderID string) ([]entity.OrderStatusChange, error) {
+	var history []entity.OrderStatusChange
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT status, accrual, changed_at FROM Order_status_history "+
+		"WHERE order_id=$1 ORDER BY changed_at, id", orderID)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		change := entity.OrderStatusChange{}
+		var accrual sql.NullFloat64
+		if err = rows.Scan(&change.Status, &accrual, &change.ChangedAt); err != nil {
+			log.Ctx(ctx).Error().Msgf("Couldn't set order status from DB: %v\n", err)
+			return nil, &ErrorDB{Err: err}
 		}
 		if accrual.Valid {
-			order.Accrual = float32(accrual.Float64)
+			change.Accrual = float32(accrual.Float64)
 		}
-		orders = append(orders, order)
+		history = append(history, change)
 	}
 	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return history, nil
+}
+
+func (db *DBStorage) GetOrders(ctx context.Context, userID int64) ([]entity.Order, error) {
+	return db.GetOrdersPage(ctx, userID, &entity.OrdersFilter{})
+}
+
+// GetOrdersPage returns the user orders matching the filter. Pages are built with keyset
+// pagination over (uploaded_at, id), so they stay stable while new orders are uploaded.
+func (db *DBStorage) GetOrdersPage(ctx context.Context, userID int64, filter *entity.OrdersFilter) ([]entity.Order, error) {
+	var orders []entity.Order
+
+	query := "SELECT " + orderColumns + " FROM Orders WHERE user_id=$1"
+	args := []interface{}{userID}
+	addArg := func(arg interface{}) string {
+		args = append(args, arg)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, 0, len(filter.Statuses))
+		for _, status := range filter.Statuses {
+			placeholders = append(placeholders, addArg(status))
+		}
+		query += " AND status IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	if filter.From != nil {
+		query += " AND uploaded_at >= " + addArg(*filter.From)
+	}
+	if filter.To != nil {
+		query += " AND uploaded_at < " + addArg(*filter.To)
+	}
+	direction, comparison := "ASC", ">"
+	if filter.Desc {
+		direction, comparison = "DESC", "<"
+	}
+	if filter.After != nil {
+		query += fmt.Sprintf(" AND (uploaded_at, id) %s (%s, %s)", comparison, addArg(filter.After.UploadedAt), addArg(filter.After.ID))
+	}
+	query += fmt.Sprintf(" ORDER BY uploaded_at %s, id %s", direction, direction)
+	if filter.Limit > 0 {
+		query += " LIMIT " + addArg(filter.Limit)
+	}
+
+	rows, err := db.dbConnection.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("Couldn't read orders for user. %s\n", err)
 		return nil, &ErrorDB{Err: err}
 	}
+	defer rows.Close()
+
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("Couldn't set order from DB: %s\n", err)
+			return nil, &ErrorDB{Err: err}
+		}
+		orders = append(orders, *order)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
 
 	return orders, nil
 }
@@ -142,27 +561,61 @@ func (db *DBStorage) AddBalance(ctx context.Context, userID int64) error {
 	if err != nil {
 		return &ErrorDB{Err: err}
 	}
-	log.Info().Msgf("Add balance for user %d\n", userID)
+	log.Ctx(ctx).Info().Msgf("Add balance for user %d\n", userID)
 	return nil
 }
 
 func (db *DBStorage) UpdateBalance(ctx context.Context, userID int64, accrual float32) error {
-	_, err := db.dbConnection.ExecContext(ctx, "UPDATE Balances SET current = current + $1 WHERE user_id=$2",
-		accrual, userID)
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE Balances SET current = current + $1 WHERE user_id=$2",
+			accrual, userID); err != nil {
+			return err
+		}
+		if accrual == 0 {
+			return nil
+		}
+		return addOutboxEvent(ctx, tx, userID, entity.OutboxBalanceCredited, entity.BalanceCredit{Sum: accrual})
+	})
 	if err != nil {
 		return &ErrorDB{Err: err}
 	}
-	log.Info().Msgf("Update balance for user %d. Add to current = %f\n", userID, accrual)
+	log.Ctx(ctx).Info().Msgf("Update balance for user %d. Add to current = %f\n", userID, accrual)
 	return nil
 }
 
-func (db *DBStorage) Withdraw(ctx context.Context, userID int64, sum float32) error {
-	_, err := db.dbConnection.ExecContext(ctx, "UPDATE Balances SET current = current - $1, withdrawn = withdrawn + $1 WHERE user_id=$2",
-		sum, userID)
+// Withdraw checks the balance and writes off the sum in one transaction, so concurrent
+// withdrawals can't take the balance below zero.
+func (db *DBStorage) Withdraw(ctx context.Context, userID int64, sum float32, orderID string) error {
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		var current float32
+		err := tx.QueryRowContext(ctx, "SELECT current FROM Balances WHERE user_id=$1 FOR UPDATE", userID).Scan(&current)
+		if err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if current < sum {
+			return ErrInsufficientFunds
+		}
+		if _, err = tx.ExecContext(ctx, "INSERT INTO Withdrawals (user_id, sum, order_id) VALUES ($1, $2, $3);",
+			userID, sum, orderID); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Balances SET current = current - $1, withdrawn = withdrawn + $1 WHERE user_id=$2",
+			sum, userID); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		withdrawal := entity.Withdrawals{Sum: sum, ProcessedAt: time.Now(), OrderID: orderID}
+		if err = addOutboxEvent(ctx, tx, userID, entity.OutboxWithdrawalMade, withdrawal); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if err = addWebhookDeliveries(ctx, tx, entity.WebhookBalanceWithdrawn, userID, "", withdrawal); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		return nil
+	})
 	if err != nil {
-		return &ErrorDB{Err: err}
+		return err
 	}
-	log.Info().Msgf("Update balance for user %d. Sum = %f\n", userID, sum)
+	log.Ctx(ctx).Info().Msgf("Withdraw for user %d. Sum = %f\n", userID, sum)
 	return nil
 }
 
@@ -171,29 +624,19 @@ func (db *DBStorage) GetBalance(ctx context.Context, userID int64) *entity.Balan
 	err := db.dbConnection.QueryRowContext(ctx, "SELECT * FROM Balances WHERE user_id=$1", userID).
 		Scan(&balance.UserID, &balance.Current, &balance.Withdrawn)
 	if err != nil {
-		log.Warn().Msgf("There is no balance data for user %d: %v\n", userID, err)
+		log.Ctx(ctx).Warn().Msgf("There is no balance data for user %d: %v\n", userID, err)
 		return nil
 	}
-	log.Info().Msgf("Get balance for user %d: %v\n", userID, balance)
+	log.Ctx(ctx).Info().Msgf("Get balance for user %d: %v\n", userID, balance)
 	return &balance
 }
 
-func (db *DBStorage) AddWithdrawal(ctx context.Context, userID int64, sum float32, orderID string) error {
-	_, err := db.dbConnection.ExecContext(ctx, "INSERT INTO Withdrawals (user_id, sum, order_id) VALUES ($1, $2, $3);",
-		userID, sum, orderID)
-	if err != nil {
-		return &ErrorDB{Err: err}
-	}
-	log.Info().Msgf("Add withdrawal for user %d\n", userID)
-	return nil
-}
-
 func (db *DBStorage) GetWithdrawals(ctx context.Context, userID int64) ([]entity.Withdrawals, error) {
 	var withdrawals []entity.Withdrawals
 
 	rows, err := db.dbConnection.QueryContext(ctx, "SELECT * FROM Withdrawals WHERE user_id=$1 ORDER BY processed_at", userID)
 	if err != nil {
-		log.Error().Msgf("No withdrawals for user. %s\n", err)
+		log.Ctx(ctx).Error().Msgf("No withdrawals for user. %s\n", err)
 		return nil, err
 	}
 
@@ -201,14 +644,21 @@ func (db *DBStorage) GetWithdrawals(ctx context.Context, userID int64) ([]entity
 		withdrawal := entity.Withdrawals{}
 		err = rows.Scan(&withdrawal.UserID, &withdrawal.Sum, &withdrawal.ProcessedAt, &withdrawal.OrderID)
 		if err != nil {
-			log.Error().Msgf("Couldn't set withdrawal from DB: %v\n", err)
+			log.Ctx(ctx).Error().Msgf("Couldn't set withdrawal from DB: %v\n", err)
 			return nil, &ErrorDB{Err: err}
 		}
 		withdrawals = append(withdrawals, withdrawal)
 	}
 	if rows.Err() != nil {
-		log.Error().Msgf("There is error while reading rows: %v\n", rows.Err())
+		log.Ctx(ctx).Error().Msgf("There is error while reading rows: %v\n", rows.Err())
 		return nil, &ErrorDB{Err: rows.Err()}
 	}
 	return withdrawals, nil
 }
+
+func (db *DBStorage) Notify(ctx context.Context, channel string, payload string) error {
+	if _, err := db.dbConnection.ExecContext(ctx, "SELECT pg_notify($1, $2)", channel, payload); err != nil {
+		return &ErrorDB{Err: err}
+	}
+	return nil
+}
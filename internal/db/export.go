@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+// GetUserSummary returns the user with the balance, as SearchUsers does.
+func (db *DBStorage) GetUserSummary(ctx context.Context, id int64) (*entity.UserSummary, error) {
+	var user entity.UserSummary
+	err := db.dbConnection.QueryRowContext(ctx, "SELECT u.id, u.login, u.is_admin, "+
+		"COALESCE(b.current, 0), COALESCE(b.withdrawn, 0), "+
+		"(SELECT count(*) FROM Orders o WHERE o.user_id = u.id) "+
+		"FROM Users u LEFT JOIN Balances b ON b.user_id = u.id WHERE u.id = $1", id).
+		Scan(&user.ID, &user.Login, &user.IsAdmin, &user.Current, &user.Withdrawn, &user.Orders)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	return &user, nil
+}
+
+// The export functions call fn for every row with the login of its owner, for the user or
+// for all users when userID is 0. Rows are read while fn consumes them, so an export of any
+// size runs one query and doesn't have to fit in memory.
+
+// ExportOrders exports orders grouped by user, oldest first.
+func (db *DBStorage) ExportOrders(ctx context.Context, userID int64, fn func(login string, order entity.Order) error) error {
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT "+orderColumns+", u.login FROM Orders "+
+		"JOIN (SELECT id AS owner_id, login FROM Users) u ON u.owner_id = user_id "+
+		"WHERE $1::bigint = 0 OR user_id = $1 ORDER BY user_id, uploaded_at, id", userID)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var login string
+		order, err := scanOrder(withLogin{rows: rows, login: &login})
+		if err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if err = fn(login, *order); err != nil {
+			return err
+		}
+	}
+	if rows.Err() != nil {
+		return &ErrorDB{Err: rows.Err()}
+	}
+	return nil
+}
+
+// ExportWithdrawals exports withdrawals grouped by user, oldest first.
+func (db *DBStorage) ExportWithdrawals(ctx context.Context, userID int64, fn func(login string, withdrawal entity.Withdrawals) error) error {
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT u.login, w.user_id, w.sum, w.processed_at, w.order_id "+
+		"FROM Withdrawals w JOIN Users u ON u.id = w.user_id "+
+		"WHERE $1::bigint = 0 OR w.user_id = $1 ORDER BY w.user_id, w.processed_at", userID)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var login string
+		withdrawal := entity.Withdrawals{}
+		err = rows.Scan(&login, &withdrawal.UserID, &withdrawal.Sum, &withdrawal.ProcessedAt, &withdrawal.OrderID)
+		if err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if err = fn(login, withdrawal); err != nil {
+			return err
+		}
+	}
+	if rows.Err() != nil {
+		return &ErrorDB{Err: rows.Err()}
+	}
+	return nil
+}
+
+// ExportAdjustments exports balance adjustments grouped by user, oldest first.
+func (db *DBStorage) ExportAdjustments(ctx context.Context, userID int64, fn func(login string, adjustment entity.BalanceAdjustment) error) error {
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT u.login, a.id, a.user_id, COALESCE(a.order_id, ''), a.amount, "+
+		"a.reason, a.created_at FROM Balance_adjustments a JOIN Users u ON u.id = a.user_id "+
+		"WHERE $1::bigint = 0 OR a.user_id = $1 ORDER BY a.user_id, a.id", userID)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var login string
+		var adjustment entity.BalanceAdjustment
+		err = rows.Scan(&login, &adjustment.ID, &adjustment.UserID, &adjustment.OrderID, &adjustment.Amount,
+			&adjustment.Reason, &adjustment.CreatedAt)
+		if err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if err = fn(login, adjustment); err != nil {
+			return err
+		}
+	}
+	if rows.Err() != nil {
+		return &ErrorDB{Err: rows.Err()}
+	}
+	return nil
+}
+
+// withLogin scans the owner login that follows the columns scanOrder reads.
+type withLogin struct {
+	rows  *sql.Rows
+	login *string
+}
+
+func (s withLogin) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, s.login)...)
+}
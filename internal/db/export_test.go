@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+func TestGetUserSummary(t *testing.T) {
+	storage := testStorage(t)
+	ctx := context.Background()
+	login := "summary-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	user := testUser(t, storage, login)
+
+	summary, err := storage.GetUserSummary(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.ID != user.ID || summary.Login != login {
+		t.Errorf("GetUserSummary(%d) = %+v, want user %s", user.ID, summary, login)
+	}
+	if _, err = storage.GetUserSummary(ctx, -1); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUserSummary of a missing user: err = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestExportOrders(t *testing.T) {
+	storage := testStorage(t)
+	ctx := context.Background()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	login := "export-" + suffix
+	user := testUser(t, storage, login)
+	ids := []string{suffix + "1", suffix + "2"}
+	for _, id := range ids {
+		if err := storage.AddOrder(ctx, id, user.ID, "NEW", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	err := storage.ExportOrders(ctx, user.ID, func(owner string, order entity.Order) error {
+		if owner != login {
+			t.Errorf("order %s exported with login %s, want %s", order.ID, owner, login)
+		}
+		got = append(got, order.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(ids) || got[0] != ids[0] || got[1] != ids[1] {
+		t.Errorf("exported orders %v, want %v", got, ids)
+	}
+
+	stop := errors.New("stop")
+	err = storage.ExportOrders(ctx, user.ID, func(string, entity.Order) error { return stop })
+	if !errors.Is(err, stop) {
+		t.Errorf("ExportOrders returned %v, want the error of fn", err)
+	}
+}
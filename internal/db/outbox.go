@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+// outboxLockKey is the advisory lock that lets only one relay publish at a time, so the
+// events of a user are never published out of order by two instances.
+const outboxLockKey = 7150036
+
+// addOutboxEvent writes the event in the transaction of the change it is about. IDs are
+// taken when rows are inserted but become visible when transactions commit, so two
+// transactions of one user could commit in the other order than their IDs and the relay
+// would publish the later event first. The per-user lock, held until commit, makes the
+// transactions of a user take their IDs and commit one after another.
+func addOutboxEvent(ctx context.Context, tx *sql.Tx, userID int64, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	// the two-key form, so it never collides with outboxLockKey
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1::int, $2::int)", outboxLockKey, userID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO Outbox (user_id, event_type, payload) VALUES ($1, $2, $3);",
+		userID, eventType, string(payload))
+	return err
+}
+
+// RelayOutbox passes the oldest unpublished events to publish and marks the IDs it returns
+// as published. It does nothing while another relay holds the lock.
+func (db *DBStorage) RelayOutbox(ctx context.Context, limit int, publish func([]entity.OutboxMessage) []int64) error {
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		var locked bool
+		if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", outboxLockKey).Scan(&locked); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if !locked {
+			return nil
+		}
+		messages, err := queryOutbox(ctx, tx, "SELECT id, user_id, event_type, payload, created_at FROM Outbox "+
+			"WHERE published_at IS NULL ORDER BY id LIMIT $1", limit)
+		if err != nil || len(messages) == 0 {
+			return err
+		}
+		published := publish(messages)
+		if len(published) == 0 {
+			return nil
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Outbox SET published_at = current_timestamp WHERE id = ANY($1::bigint[])", published); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		return nil
+	})
+}
+
+// GetOutbox returns events after fromID, published or not, for replay. userID 0 means all users.
+// The events of one user become visible in ID order, see addOutboxEvent, but a smaller ID of
+// another user may still be uncommitted, so a position kept as an ID is exact per user only.
+func (db *DBStorage) GetOutbox(ctx context.Context, fromID int64, userID int64, limit int) ([]entity.OutboxMessage, error) {
+	return queryOutbox(ctx, db.dbConnection, "SELECT id, user_id, event_type, payload, created_at FROM Outbox "+
+		"WHERE id > $1 AND ($2 = 0 OR user_id = $2) ORDER BY id LIMIT $3", fromID, userID, limit)
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryOutbox(ctx context.Context, q queryer, query string, args ...interface{}) ([]entity.OutboxMessage, error) {
+	var messages []entity.OutboxMessage
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		message := entity.OutboxMessage{}
+		var payload string
+		if err = rows.Scan(&message.ID, &message.UserID, &message.Type, &payload, &message.CreatedAt); err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		message.Payload = json.RawMessage(payload)
+		messages = append(messages, message)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return messages, nil
+}
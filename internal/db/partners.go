@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgconn"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrPartnerExists   = errors.New("partner already exists")
+	ErrPartnerNotFound = errors.New("partner not found")
+)
+
+// AddPartner registers a partner shop with the hash of its API key.
+func (db *DBStorage) AddPartner(ctx context.Context, name string, keyHash string) error {
+	_, err := db.dbConnection.ExecContext(ctx, "INSERT INTO Partners (name, key_hash) VALUES ($1, $2)", name, keyHash)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrPartnerExists
+	}
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	log.Ctx(ctx).Info().Msgf("Add partner %s\n", name)
+	return nil
+}
+
+// RotatePartnerKey replaces the API key of the partner, the old key stops working.
+func (db *DBStorage) RotatePartnerKey(ctx context.Context, name string, keyHash string) error {
+	res, err := db.dbConnection.ExecContext(ctx, "UPDATE Partners SET key_hash=$1 WHERE name=$2", keyHash, name)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPartnerNotFound
+	}
+	log.Ctx(ctx).Info().Msgf("Rotate key of partner %s\n", name)
+	return nil
+}
+
+// GetPartnerByKey returns the partner the API key belongs to.
+func (db *DBStorage) GetPartnerByKey(ctx context.Context, keyHash string) (string, error) {
+	var name string
+	err := db.dbConnection.QueryRowContext(ctx, "SELECT name FROM Partners WHERE key_hash=$1", keyHash).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrPartnerNotFound
+	}
+	if err != nil {
+		return "", &ErrorDB{Err: err}
+	}
+	return name, nil
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+const (
+	PromoSingleUse = "single"
+	PromoMultiUse  = "multi"
+)
+
+var (
+	ErrPromoExists       = errors.New("promo code already exists")
+	ErrPromoNotFound     = errors.New("promo code not found")
+	ErrPromoNotActive    = errors.New("promo code is not active yet")
+	ErrPromoExpired      = errors.New("promo code has expired")
+	ErrPromoExhausted    = errors.New("promo code has been fully redeemed")
+	ErrPromoLimitReached = errors.New("promo code redemption limit for user reached")
+)
+
+func (db *DBStorage) AddPromo(ctx context.Context, promo *entity.Promo) error {
+	res, err := db.dbConnection.ExecContext(ctx, "INSERT INTO Promos (code, points, mode, total_limit, per_user_limit, valid_from, valid_until) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (code) DO NOTHING;",
+		promo.Code, promo.Points, promo.Mode, promo.TotalLimit, promo.PerUserLimit, promo.ValidFrom, promo.ValidUntil)
+	if err != nil {
+		return &ErrorDB{Err: fmt.Errorf("couldn't add promo %s into DB: %s", promo.Code, err)}
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPromoExists
+	}
+	log.Ctx(ctx).Info().Msgf("Add promo %s\n", promo.Code)
+	return nil
+}
+
+func (db *DBStorage) GetPromos(ctx context.Context) ([]entity.Promo, error) {
+	var promos []entity.Promo
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT code, points, mode, total_limit, per_user_limit, valid_from, valid_until, redeemed "+
+		"FROM Promos ORDER BY code")
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		promo, err := scanPromo(rows)
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("Couldn't set promo from DB: %v\n", err)
+			return nil, &ErrorDB{Err: err}
+		}
+		promos = append(promos, *promo)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return promos, nil
+}
+
+// RedeemPromo credits the promo points to the user balance. The promo row is locked
+// for the whole transaction, so concurrent redemptions of one code are serialized
+// and can't exceed the limits.
+func (db *DBStorage) RedeemPromo(ctx context.Context, code string, userID int64) (*entity.Promo, error) {
+	var promo *entity.Promo
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		promo, err = scanPromo(tx.QueryRowContext(ctx, "SELECT code, points, mode, total_limit, per_user_limit, valid_from, valid_until, redeemed "+
+			"FROM Promos WHERE code=$1 FOR UPDATE", code))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPromoNotFound
+		}
+		if err != nil {
+			return &ErrorDB{Err: err}
+		}
+
+		now := time.Now()
+		if promo.ValidFrom != nil && now.Before(*promo.ValidFrom) {
+			return ErrPromoNotActive
+		}
+		if promo.ValidUntil != nil && now.After(*promo.ValidUntil) {
+			return ErrPromoExpired
+		}
+		totalLimit := promo.TotalLimit
+		if promo.Mode == PromoSingleUse {
+			totalLimit = 1
+		}
+		if totalLimit > 0 && promo.Redeemed >= totalLimit {
+			return ErrPromoExhausted
+		}
+		if promo.PerUserLimit > 0 {
+			var userRedeemed int
+			err = tx.QueryRowContext(ctx, "SELECT count(*) FROM Promo_redemptions WHERE code=$1 AND user_id=$2", code, userID).
+				Scan(&userRedeemed)
+			if err != nil {
+				return &ErrorDB{Err: err}
+			}
+			if userRedeemed >= promo.PerUserLimit {
+				return ErrPromoLimitReached
+			}
+		}
+
+		if _, err = tx.ExecContext(ctx, "INSERT INTO Promo_redemptions (code, user_id) VALUES ($1, $2);", code, userID); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Promos SET redeemed = redeemed + 1 WHERE code=$1", code); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Balances SET current = current + $1 WHERE user_id=$2", promo.Points, userID); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if err = addOutboxEvent(ctx, tx, userID, entity.OutboxBalanceCredited,
+			entity.BalanceCredit{Sum: promo.Points, Promo: code}); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		promo.Redeemed++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Ctx(ctx).Info().Msgf("User %d redeemed promo %s for %f points\n", userID, code, promo.Points)
+	return promo, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPromo(row rowScanner) (*entity.Promo, error) {
+	promo := entity.Promo{}
+	var validFrom, validUntil sql.NullTime
+	err := row.Scan(&promo.Code, &promo.Points, &promo.Mode, &promo.TotalLimit, &promo.PerUserLimit,
+		&validFrom, &validUntil, &promo.Redeemed)
+	if err != nil {
+		return nil, err
+	}
+	if validFrom.Valid {
+		promo.ValidFrom = &validFrom.Time
+	}
+	if validUntil.Valid {
+		promo.ValidUntil = &validUntil.Time
+	}
+	return &promo, nil
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+// testStorage connects to TEST_DATABASE_URI, or DATABASE_URI, and skips the test when neither is set.
+func testStorage(t *testing.T) *DBStorage {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		dsn = os.Getenv("DATABASE_URI")
+	}
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI or DATABASE_URI is not set")
+	}
+	storage, err := New(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = storage.dbConnection.Close() })
+	if err = storage.Ping(context.Background()); err != nil {
+		t.Fatalf("couldn't connect to the test database: %v", err)
+	}
+	storage.Create(context.Background())
+	return storage
+}
+
+func testUser(t *testing.T, storage *DBStorage, login string) *entity.User {
+	t.Helper()
+	ctx := context.Background()
+	if err := storage.AddUser(ctx, login, "hash"); err != nil {
+		t.Fatal(err)
+	}
+	user := storage.GetUser(ctx, login)
+	if user == nil {
+		t.Fatalf("user %s wasn't added", login)
+	}
+	if err := storage.AddBalance(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestRedeemPromoConcurrently(t *testing.T) {
+	storage := testStorage(t)
+	ctx := context.Background()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	user := testUser(t, storage, "promo-"+suffix)
+
+	const (
+		redeemers = 20
+		limit     = 3
+		points    = 10
+	)
+	code := "RACE-" + suffix
+	if err := storage.AddPromo(ctx, &entity.Promo{Code: code, Points: points, Mode: PromoMultiUse, TotalLimit: limit}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, redeemers)
+	for i := 0; i < redeemers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := storage.RedeemPromo(ctx, code, user.ID)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, ErrPromoExhausted):
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if succeeded != limit {
+		t.Errorf("%d redemptions succeeded, want %d", succeeded, limit)
+	}
+	balance := storage.GetBalance(ctx, user.ID)
+	if balance == nil {
+		t.Fatal("no balance")
+	}
+	if balance.Current != float32(succeeded*points) {
+		t.Errorf("balance = %v, want %v", balance.Current, succeeded*points)
+	}
+	var redeemed int
+	if err := storage.dbConnection.QueryRowContext(ctx, "SELECT redeemed FROM Promos WHERE code=$1", code).Scan(&redeemed); err != nil {
+		t.Fatal(err)
+	}
+	if redeemed != limit {
+		t.Errorf("promo redeemed = %d, want %d", redeemed, limit)
+	}
+}
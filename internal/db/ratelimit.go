@@ -0,0 +1,35 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// HitRateLimit counts a request of key in the current window of length per and returns the
+// count and how long the window lasts. Windows are taken from the database clock, so all
+// instances agree on them.
+func (db *DBStorage) HitRateLimit(ctx context.Context, key string, per time.Duration) (int, time.Duration, error) {
+	var count int
+	var left float64
+	err := db.dbConnection.QueryRowContext(ctx, "INSERT INTO Rate_limits (key, window_start, count) "+
+		"VALUES ($1, to_timestamp(floor(extract(epoch FROM now()) / $2::float8) * $2::float8), 1) "+
+		"ON CONFLICT (key) DO UPDATE SET "+
+		"count = CASE WHEN Rate_limits.window_start = EXCLUDED.window_start THEN Rate_limits.count + 1 ELSE 1 END, "+
+		"window_start = EXCLUDED.window_start "+
+		"RETURNING count, extract(epoch FROM window_start + make_interval(secs => $2::float8) - now())",
+		key, per.Seconds()).Scan(&count, &left)
+	if err != nil {
+		return 0, 0, &ErrorDB{Err: err}
+	}
+	return count, time.Duration(left * float64(time.Second)), nil
+}
+
+// DeleteStaleRateLimits removes counters of keys not seen since before.
+func (db *DBStorage) DeleteStaleRateLimits(ctx context.Context, before time.Duration) error {
+	_, err := db.dbConnection.ExecContext(ctx, "DELETE FROM Rate_limits WHERE window_start < now() - make_interval(secs => $1::float8)",
+		before.Seconds())
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+	"github.com/fortuna91/ya_praktikum_final/internal/metrics"
+)
+
+// ErrOrderChanged is returned when the order has changed since the discrepancy was found.
+var ErrOrderChanged = errors.New("order has changed since the discrepancy was found")
+
+// GetProcessedOrdersSince returns orders that became PROCESSED after since, ordered by ID
+// and starting after afterID.
+func (db *DBStorage) GetProcessedOrdersSince(ctx context.Context, since time.Time, afterID string, limit int) ([]entity.Order, error) {
+	var orders []entity.Order
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT "+orderColumns+" FROM Orders o WHERE status=$1 AND id > $2 "+
+		"AND EXISTS (SELECT 1 FROM Order_status_history h WHERE h.order_id = o.id AND h.status = $1 AND h.changed_at >= $3) "+
+		"ORDER BY id LIMIT $4", processedStatus, afterID, since, limit)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		orders = append(orders, *order)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return orders, nil
+}
+
+// AddDiscrepancy records the discrepancy, or updates the open one of the same order.
+func (db *DBStorage) AddDiscrepancy(ctx context.Context, discrepancy *entity.AccrualDiscrepancy) error {
+	err := db.dbConnection.QueryRowContext(ctx, "INSERT INTO Accrual_discrepancies "+
+		"(order_id, user_id, status, accrual, actual_status, actual_accrual) VALUES ($1, $2, $3, $4, $5, $6) "+
+		"ON CONFLICT (order_id) WHERE adjustment_id IS NULL DO UPDATE SET status = excluded.status, "+
+		"accrual = excluded.accrual, actual_status = excluded.actual_status, actual_accrual = excluded.actual_accrual, "+
+		"detected_at = current_timestamp RETURNING id, detected_at",
+		discrepancy.OrderID, discrepancy.UserID, discrepancy.Status, discrepancy.Accrual,
+		discrepancy.ActualStatus, discrepancy.ActualAccrual).Scan(&discrepancy.ID, &discrepancy.DetectedAt)
+	if err != nil {
+		return &ErrorDB{Err: fmt.Errorf("couldn't add discrepancy of order %s: %s", discrepancy.OrderID, err)}
+	}
+	log.Ctx(ctx).Warn().Msgf("Accrual discrepancy of order %s: %f, accrual system says %s %f\n", discrepancy.OrderID,
+		discrepancy.Accrual, discrepancy.ActualStatus, discrepancy.ActualAccrual)
+	return nil
+}
+
+// GetDiscrepancies returns the latest discrepancies, open and corrected.
+func (db *DBStorage) GetDiscrepancies(ctx context.Context, limit int) ([]entity.AccrualDiscrepancy, error) {
+	var discrepancies []entity.AccrualDiscrepancy
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT id, order_id, user_id, status, accrual, actual_status, "+
+		"actual_accrual, detected_at, adjustment_id FROM Accrual_discrepancies ORDER BY id DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		discrepancy := entity.AccrualDiscrepancy{}
+		var adjustmentID sql.NullInt64
+		err = rows.Scan(&discrepancy.ID, &discrepancy.OrderID, &discrepancy.UserID, &discrepancy.Status, &discrepancy.Accrual,
+			&discrepancy.ActualStatus, &discrepancy.ActualAccrual, &discrepancy.DetectedAt, &adjustmentID)
+		if err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		if adjustmentID.Valid {
+			discrepancy.AdjustmentID = &adjustmentID.Int64
+		}
+		discrepancies = append(discrepancies, discrepancy)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return discrepancies, nil
+}
+
+// CorrectDiscrepancy sets the order status and accrual to the actual ones and posts the difference to
+// the balance as an adjustment. It fails with ErrOrderChanged when the order accrual is not
+// the one the discrepancy was found for.
+func (db *DBStorage) CorrectDiscrepancy(ctx context.Context, discrepancy *entity.AccrualDiscrepancy) (*entity.BalanceAdjustment, error) {
+	var adjustment *entity.BalanceAdjustment
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		order, err := scanOrder(tx.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM Orders WHERE id=$1 FOR UPDATE", discrepancy.OrderID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		if err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if order.Status != discrepancy.Status || order.Accrual != discrepancy.Accrual {
+			return ErrOrderChanged
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Orders SET status=$2, accrual=$3 WHERE id=$1",
+			order.ID, discrepancy.ActualStatus, discrepancy.ActualAccrual); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if discrepancy.ActualStatus != order.Status {
+			if err = addOrderStatus(ctx, tx, order.ID, discrepancy.ActualStatus, discrepancy.ActualAccrual); err != nil {
+				return &ErrorDB{Err: err}
+			}
+		}
+		reason := fmt.Sprintf("accrual reconciliation: %s %.2f -> %s %.2f", discrepancy.Status, discrepancy.Accrual,
+			discrepancy.ActualStatus, discrepancy.ActualAccrual)
+		adjustment, err = addAdjustment(ctx, tx, order.UserID, order.ID, discrepancy.ActualAccrual-discrepancy.Accrual, reason)
+		if err != nil {
+			return &ErrorDB{Err: err}
+		}
+		if _, err = tx.ExecContext(ctx, "UPDATE Accrual_discrepancies SET adjustment_id=$2 WHERE id=$1",
+			discrepancy.ID, adjustment.ID); err != nil {
+			return &ErrorDB{Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	discrepancy.AdjustmentID = &adjustment.ID
+	metrics.Credit(metrics.SourceReconciliation, adjustment.Amount)
+	log.Ctx(ctx).Info().Msgf("Adjust balance of user %d by %f: %s\n", adjustment.UserID, adjustment.Amount, adjustment.Reason)
+	return adjustment, nil
+}
+
+// AdjustBalance posts a manual adjustment to the user balance.
+func (db *DBStorage) AdjustBalance(ctx context.Context, userID int64, amount float32, reason string) (*entity.BalanceAdjustment, error) {
+	var adjustment *entity.BalanceAdjustment
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		adjustment, err = addAdjustment(ctx, tx, userID, "", amount, reason)
+		return err
+	})
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	metrics.Credit(metrics.SourceAdjustment, amount)
+	log.Ctx(ctx).Info().Msgf("Adjust balance of user %d by %f: %s\n", userID, amount, reason)
+	return adjustment, nil
+}
+
+// addAdjustment records the adjustment and applies it to the balance. The balance may
+// become negative when points that have been spent are taken back.
+func addAdjustment(ctx context.Context, tx *sql.Tx, userID int64, orderID string, amount float32, reason string) (*entity.BalanceAdjustment, error) {
+	adjustment := entity.BalanceAdjustment{UserID: userID, OrderID: orderID, Amount: amount, Reason: reason}
+	err := tx.QueryRowContext(ctx, "INSERT INTO Balance_adjustments (user_id, order_id, amount, reason) "+
+		"VALUES ($1, NULLIF($2, ''), $3, $4) RETURNING id, created_at", userID, orderID, amount, reason).
+		Scan(&adjustment.ID, &adjustment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE Balances SET current = current + $1 WHERE user_id=$2", amount, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("there is no balance for user %d", userID)
+	}
+	if err = addOutboxEvent(ctx, tx, userID, entity.OutboxBalanceAdjusted, adjustment); err != nil {
+		return nil, err
+	}
+	return &adjustment, nil
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+type webhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// addWebhookDeliveries writes a delivery for every webhook subscribed to the event inside
+// the transaction of the change itself, so an event is never lost or sent for a rolled
+// back change. Partner webhooks get the events of orders the partner has submitted.
+func addWebhookDeliveries(ctx context.Context, tx *sql.Tx, event string, userID int64, partner string, data interface{}) error {
+	payload, err := json.Marshal(webhookPayload{Event: event, CreatedAt: time.Now(), Data: data})
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO Webhook_deliveries (webhook_id, event, payload) "+
+		"SELECT id, $1::text, $2 FROM Webhooks WHERE $1::text = ANY(string_to_array(events, ',')) "+
+		"AND (user_id = $3 OR (partner IS NOT NULL AND partner = NULLIF($4::text, '')))",
+		event, string(payload), userID, partner)
+	return err
+}
+
+// AddWebhook registers a user webhook when userID is set, otherwise a partner webhook.
+func (db *DBStorage) AddWebhook(ctx context.Context, userID *int64, webhook *entity.Webhook) error {
+	err := db.dbConnection.QueryRowContext(ctx, "INSERT INTO Webhooks (user_id, partner, url, secret, events) "+
+		"VALUES ($1, NULLIF($2::text, ''), $3, $4, $5) RETURNING id, created_at",
+		userID, webhook.Partner, webhook.URL, webhook.Secret, strings.Join(webhook.Events, ",")).
+		Scan(&webhook.ID, &webhook.CreatedAt)
+	if err != nil {
+		return &ErrorDB{Err: fmt.Errorf("couldn't add webhook into DB: %s", err)}
+	}
+	log.Ctx(ctx).Info().Msgf("Add webhook %d\n", webhook.ID)
+	return nil
+}
+
+// GetWebhooks returns the user webhooks, or all partner webhooks when userID is nil.
+func (db *DBStorage) GetWebhooks(ctx context.Context, userID *int64) ([]entity.Webhook, error) {
+	var webhooks []entity.Webhook
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT id, partner, url, events, created_at FROM Webhooks "+
+		"WHERE ($1::bigint IS NULL AND user_id IS NULL) OR user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		webhook := entity.Webhook{}
+		var partner sql.NullString
+		var events string
+		if err = rows.Scan(&webhook.ID, &partner, &webhook.URL, &events, &webhook.CreatedAt); err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		webhook.Partner = partner.String
+		webhook.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, webhook)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return webhooks, nil
+}
+
+func (db *DBStorage) DeleteWebhook(ctx context.Context, userID *int64, id int64) error {
+	res, err := db.dbConnection.ExecContext(ctx, "DELETE FROM Webhooks WHERE id=$1 AND "+
+		"(($2::bigint IS NULL AND user_id IS NULL) OR user_id = $2)", id, userID)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+const deliveryColumns = "d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.last_error, d.response_code, d.created_at, d.delivered_at"
+
+func scanDelivery(row rowScanner) (*entity.WebhookDelivery, error) {
+	delivery := entity.WebhookDelivery{}
+	var lastError sql.NullString
+	var responseCode sql.NullInt64
+	var deliveredAt sql.NullTime
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &delivery.Payload, &delivery.Status,
+		&delivery.Attempts, &lastError, &responseCode, &delivery.CreatedAt, &deliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	delivery.LastError = lastError.String
+	delivery.ResponseCode = int(responseCode.Int64)
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = &deliveredAt.Time
+	}
+	return &delivery, nil
+}
+
+// GetWebhookDeliveries returns the delivery log of the webhook, newest first.
+func (db *DBStorage) GetWebhookDeliveries(ctx context.Context, userID *int64, webhookID int64, limit int) ([]entity.WebhookDelivery, error) {
+	var deliveries []entity.WebhookDelivery
+
+	rows, err := db.dbConnection.QueryContext(ctx, "SELECT "+deliveryColumns+" FROM Webhook_deliveries d "+
+		"JOIN Webhooks w ON w.id = d.webhook_id WHERE d.webhook_id=$1 AND "+
+		"(($2::bigint IS NULL AND w.user_id IS NULL) OR w.user_id = $2) ORDER BY d.id DESC LIMIT $3", webhookID, userID, limit)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhook schedules the delivery to be sent again right away, with a fresh retry
+// budget.
+func (db *DBStorage) RedeliverWebhook(ctx context.Context, userID *int64, deliveryID int64) error {
+	res, err := db.dbConnection.ExecContext(ctx, "UPDATE Webhook_deliveries d SET status=$3, attempts=0, "+
+		"next_attempt_at=current_timestamp "+
+		"FROM Webhooks w WHERE w.id = d.webhook_id AND d.id=$1 AND "+
+		"(($2::bigint IS NULL AND w.user_id IS NULL) OR w.user_id = $2)", deliveryID, userID, DeliveryPending)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDeliveryNotFound
+	}
+	log.Ctx(ctx).Info().Msgf("Redeliver webhook delivery %d\n", deliveryID)
+	return nil
+}
+
+// ClaimWebhookDeliveries takes due deliveries and postpones them by lease, so other
+// instances don't send them at the same time.
+func (db *DBStorage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]entity.WebhookDelivery, error) {
+	var deliveries []entity.WebhookDelivery
+
+	rows, err := db.dbConnection.QueryContext(ctx, "UPDATE Webhook_deliveries d "+
+		"SET attempts = d.attempts + 1, next_attempt_at = current_timestamp + $2::double precision * interval '1 millisecond' "+
+		"FROM Webhooks w WHERE w.id = d.webhook_id AND d.id IN ("+
+		"SELECT id FROM Webhook_deliveries WHERE status=$3 AND next_attempt_at <= current_timestamp "+
+		"ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED) "+
+		"RETURNING "+deliveryColumns+", w.url, w.secret", limit, lease.Milliseconds(), DeliveryPending)
+	if err != nil {
+		return nil, &ErrorDB{Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		delivery := entity.WebhookDelivery{}
+		var lastError sql.NullString
+		var responseCode sql.NullInt64
+		var deliveredAt sql.NullTime
+		err = rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &delivery.Payload, &delivery.Status,
+			&delivery.Attempts, &lastError, &responseCode, &delivery.CreatedAt, &deliveredAt, &delivery.URL, &delivery.Secret)
+		if err != nil {
+			return nil, &ErrorDB{Err: err}
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if rows.Err() != nil {
+		return nil, &ErrorDB{Err: rows.Err()}
+	}
+	return deliveries, nil
+}
+
+func (db *DBStorage) CompleteWebhookDelivery(ctx context.Context, id int64, responseCode int) error {
+	_, err := db.dbConnection.ExecContext(ctx, "UPDATE Webhook_deliveries SET status=$2, response_code=$3, "+
+		"last_error=NULL, delivered_at=current_timestamp WHERE id=$1", id, DeliveryDelivered, responseCode)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	return nil
+}
+
+// FailWebhookDelivery records the failed attempt. The delivery is retried after retryIn,
+// or marked failed once maxAttempts is reached.
+func (db *DBStorage) FailWebhookDelivery(ctx context.Context, id int64, responseCode int, lastError string,
+	retryIn time.Duration, maxAttempts int) error {
+	_, err := db.dbConnection.ExecContext(ctx, "UPDATE Webhook_deliveries SET response_code=NULLIF($2, 0), last_error=$3, "+
+		"next_attempt_at = current_timestamp + $4::double precision * interval '1 millisecond', "+
+		"status = CASE WHEN attempts >= $5 THEN $6::text ELSE status END WHERE id=$1",
+		id, responseCode, lastError, retryIn.Milliseconds(), maxAttempts, DeliveryFailed)
+	if err != nil {
+		return &ErrorDB{Err: err}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package entity
 
 import (
+	"encoding/json"
 	"github.com/dgrijalva/jwt-go/v4"
 	"time"
 )
@@ -10,6 +11,12 @@ type User struct {
 	ID       int64  `json:"-"`
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	IsAdmin  bool   `json:"-"`
+}
+
+type Credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
 }
 
 type Order struct {
@@ -18,10 +25,68 @@ type Order struct {
 	Status     string    `json:"status"`
 	Accrual    float32   `json:"accrual,omitempty"`
 	UploadedAt time.Time `json:"uploaded_at"`
+	Partner    string    `json:"-"`
+	// Provider is the accrual provider that has calculated the order.
+	Provider string `json:"-"`
+	// TraceParent is the W3C traceparent of the upload request.
+	TraceParent string `json:"-"`
 	// for accrual system
 	// OrderID string `json:"order,omitempty"`
 }
 
+// FailedOrder is a dead-lettered order with the reason of the last failure.
+type FailedOrder struct {
+	Number     string    `json:"number"`
+	UserID     int64     `json:"user_id"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at,omitempty"`
+}
+
+// AccrualResult is the order calculation of the accrual system.
+type AccrualResult struct {
+	Order   string  `json:"order"`
+	Status  string  `json:"status"`
+	Accrual float32 `json:"accrual,omitempty"`
+}
+
+const (
+	BatchAccepted     = "accepted"
+	BatchAlreadyYours = "already_yours"
+	BatchAnotherUser  = "belongs_to_another_user"
+	BatchInvalid      = "invalid"
+)
+
+type BatchOrderResult struct {
+	Number string `json:"number"`
+	Status string `json:"status"`
+}
+
+type OrderStatusChange struct {
+	Status    string    `json:"status"`
+	Accrual   float32   `json:"accrual,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+type OrderDetails struct {
+	Order
+	Timeline []OrderStatusChange `json:"timeline"`
+}
+
+type OrderCursor struct {
+	UploadedAt time.Time `json:"t"`
+	ID         string    `json:"id"`
+}
+
+type OrdersFilter struct {
+	Statuses []string
+	From     *time.Time
+	To       *time.Time
+	Desc     bool
+	Limit    int
+	After    *OrderCursor
+}
+
 type Balance struct {
 	UserID    int64   `json:"-"`
 	Current   float32 `json:"current"`
@@ -34,3 +99,114 @@ type Withdrawals struct {
 	ProcessedAt time.Time `json:"processed_at"`
 	OrderID     string    `json:"order"`
 }
+
+type Promo struct {
+	Code         string     `json:"code"`
+	Points       float32    `json:"points"`
+	Mode         string     `json:"mode"`
+	TotalLimit   int        `json:"total_limit,omitempty"`
+	PerUserLimit int        `json:"per_user_limit,omitempty"`
+	ValidFrom    *time.Time `json:"valid_from,omitempty"`
+	ValidUntil   *time.Time `json:"valid_until,omitempty"`
+	Redeemed     int        `json:"redeemed"`
+}
+
+type PromoRedemption struct {
+	Code   string  `json:"code"`
+	Points float32 `json:"points,omitempty"`
+}
+
+const (
+	WebhookOrderProcessed   = "order.processed"
+	WebhookBalanceWithdrawn = "balance.withdrawn"
+)
+
+type Webhook struct {
+	ID        int64     `json:"id"`
+	Partner   string    `json:"partner,omitempty"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID           int64      `json:"id"`
+	WebhookID    int64      `json:"webhook_id"`
+	Event        string     `json:"event"`
+	Payload      string     `json:"payload"`
+	Status       string     `json:"status"`
+	Attempts     int        `json:"attempts"`
+	LastError    string     `json:"last_error,omitempty"`
+	ResponseCode int        `json:"response_code,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	DeliveredAt  *time.Time `json:"delivered_at,omitempty"`
+
+	// filled when the delivery is claimed for sending
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+const (
+	OutboxOrderAdded      = "order.added"
+	OutboxOrderProcessed  = "order.processed"
+	OutboxOrderFailed     = "order.failed"
+	OutboxBalanceCredited = "balance.credited"
+	OutboxWithdrawalMade  = "withdrawal.made"
+	OutboxBalanceAdjusted = "balance.adjusted"
+)
+
+type OutboxMessage struct {
+	ID        int64           `json:"id"`
+	UserID    int64           `json:"user_id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type BalanceCredit struct {
+	Sum     float32 `json:"sum"`
+	OrderID string  `json:"order,omitempty"`
+	Promo   string  `json:"promo,omitempty"`
+}
+
+type BalanceAdjustment struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	OrderID   string    `json:"order,omitempty"`
+	Amount    float32   `json:"amount"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AccrualDiscrepancy is an order whose accrual differs from the one the accrual system
+// reports now.
+type AccrualDiscrepancy struct {
+	ID            int64     `json:"id,omitempty"`
+	OrderID       string    `json:"order"`
+	UserID        int64     `json:"user_id"`
+	Status        string    `json:"status"`
+	Accrual       float32   `json:"accrual"`
+	ActualStatus  string    `json:"actual_status"`
+	ActualAccrual float32   `json:"actual_accrual"`
+	DetectedAt    time.Time `json:"detected_at,omitempty"`
+	AdjustmentID  *int64    `json:"adjustment_id,omitempty"`
+}
+
+// UserSummary is a user with the balance, as operators see it.
+type UserSummary struct {
+	ID        int64   `json:"id"`
+	Login     string  `json:"login"`
+	IsAdmin   bool    `json:"is_admin"`
+	Current   float32 `json:"current"`
+	Withdrawn float32 `json:"withdrawn"`
+	Orders    int     `json:"orders"`
+}
+
+// BalanceEntry is a change of a balance: an accrual, a withdrawal, a promo or an adjustment.
+type BalanceEntry struct {
+	Kind      string    `json:"kind"`
+	Reference string    `json:"reference"`
+	Amount    float32   `json:"amount"`
+	At        time.Time `json:"at"`
+}
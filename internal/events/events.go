@@ -0,0 +1,138 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	TypeOrder   = "order"
+	TypeBalance = "balance"
+)
+
+type Event struct {
+	ID     int64           `json:"id"`
+	UserID int64           `json:"user_id"`
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// Remote delivers events to every instance, including this one. When it is set, Publish
+// doesn't dispatch locally and relies on the remote to call Dispatch.
+type Remote func(ctx context.Context, event Event) error
+
+type Broker struct {
+	mu          sync.Mutex
+	lastID      int64
+	historySize int
+	history     map[int64][]Event
+	subscribers map[int64]map[chan Event]struct{}
+	remote      Remote
+}
+
+var Default = NewBroker(100)
+
+func NewBroker(historySize int) *Broker {
+	return &Broker{
+		historySize: historySize,
+		history:     make(map[int64][]Event),
+		subscribers: make(map[int64]map[chan Event]struct{}),
+	}
+}
+
+func (b *Broker) SetRemote(remote Remote) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remote = remote
+}
+
+// Publish sends an event of the given type to all streams of the user.
+func (b *Broker) Publish(ctx context.Context, userID int64, eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Error().Msgf("Couldn't convert event to JSON: %v", err)
+		return
+	}
+	event := Event{ID: b.nextID(), UserID: userID, Type: eventType, Data: payload}
+
+	b.mu.Lock()
+	remote := b.remote
+	b.mu.Unlock()
+	if remote != nil {
+		if err = remote(ctx, event); err == nil {
+			return
+		}
+		log.Error().Msgf("Couldn't publish event remotely, dispatch locally: %v", err)
+	}
+	b.Dispatch(event)
+}
+
+// nextID returns microseconds since epoch, so IDs from different instances stay roughly
+// ordered and a client can resume on any of them.
+func (b *Broker) nextID() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := time.Now().UnixMicro()
+	if id <= b.lastID {
+		id = b.lastID + 1
+	}
+	b.lastID = id
+	return id
+}
+
+// Dispatch stores the event for resume and passes it to local subscribers.
+func (b *Broker) Dispatch(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if event.ID > b.lastID {
+		b.lastID = event.ID
+	}
+	history := append(b.history[event.UserID], event)
+	if len(history) > b.historySize {
+		history = history[len(history)-b.historySize:]
+	}
+	b.history[event.UserID] = history
+
+	for ch := range b.subscribers[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+			log.Warn().Msgf("Events subscriber of user %d is too slow, event %d dropped", event.UserID, event.ID)
+		}
+	}
+}
+
+// Subscribe returns a channel with new events of the user and the stored events after
+// lastEventID. The returned function must be called to unsubscribe.
+func (b *Broker) Subscribe(userID int64, lastEventID int64) (<-chan Event, []Event, func()) {
+	ch := make(chan Event, b.historySize)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan Event]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+
+	var missed []Event
+	if lastEventID > 0 {
+		for _, event := range b.history[userID] {
+			if event.ID > lastEventID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	return ch, missed, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[userID], ch)
+		if len(b.subscribers[userID]) == 0 {
+			delete(b.subscribers, userID)
+		}
+	}
+}
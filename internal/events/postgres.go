@@ -0,0 +1,67 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const Channel = "gophermart_events"
+
+// Notifier sends a PostgreSQL notification, it is implemented by db.DBStorage.
+type Notifier interface {
+	Notify(ctx context.Context, channel string, payload string) error
+}
+
+// PostgresRemote publishes events with NOTIFY, so every instance listening the channel
+// gets them.
+func PostgresRemote(notifier Notifier) Remote {
+	return func(ctx context.Context, event Event) error {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return notifier.Notify(ctx, Channel, string(payload))
+	}
+}
+
+// ListenPostgres dispatches events from the notification channel into the broker until
+// ctx is done. The connection is restored after failures.
+func ListenPostgres(ctx context.Context, dbAddress string, broker *Broker) {
+	for ctx.Err() == nil {
+		if err := listen(ctx, dbAddress, broker); err != nil && ctx.Err() == nil {
+			log.Error().Msgf("Events listener failed, reconnecting: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+func listen(ctx context.Context, dbAddress string, broker *Broker) error {
+	conn, err := pgx.Connect(ctx, dbAddress)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, "LISTEN "+Channel); err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		event := Event{}
+		if err = json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+			log.Error().Msgf("Wrong event notification: %v", err)
+			continue
+		}
+		broker.Dispatch(event)
+	}
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/accrual"
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+const failedOrdersLimit = 1000
+
+var accrualStatuses = map[string]bool{
+	accrual.REGISTERED: true,
+	accrual.PROCESSING: true,
+	"INVALID":          true,
+	"PROCESSED":        true,
+}
+
+// AccrualCallback takes a result pushed by the accrual system. It is idempotent: the
+// result is applied through the same path as polling, so a repeated push or a push after
+// polling doesn't credit the order twice.
+func AccrualCallback(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	respBody, err := body.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	result := entity.AccrualResult{}
+	if errJSON := body.DecodeJSON(respBody, &result); errJSON != nil {
+		writeError(w, r, errJSON)
+		return
+	}
+	if errRequired := requireFields(
+		requiredField{"order", result.Order != ""},
+		requiredField{"status", result.Status != ""},
+	); errRequired != nil {
+		writeError(w, r, errRequired)
+		return
+	}
+	if !accrualStatuses[result.Status] {
+		writeError(w, r, apierror.Validation(apierror.FieldError{Field: "status", Message: "unknown status " + result.Status}))
+		return
+	}
+	if result.Accrual < 0 {
+		writeError(w, r, apierror.Validation(apierror.FieldError{Field: "accrual", Message: "must not be negative"}))
+		return
+	}
+
+	order := dbStorage.GetOrder(ctx, result.Order)
+	if order == nil {
+		writeError(w, r, ErrOrderNotFound)
+		return
+	}
+	provider := accrual.ProviderFor(*order).Name()
+	if err = accrual.Apply(ctx, dbStorage, order.ID, provider, result.Status, result.Accrual); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetFailedOrders lists dead-lettered orders for admins.
+func GetFailedOrders(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	orders, err := dbStorage.GetFailedOrders(ctx, failedOrdersLimit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if orders == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, orders)
+}
+
+// RequeueOrder gives a dead-lettered order a new retry budget and polls it right away.
+func RequeueOrder(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	order, err := dbStorage.RequeueOrder(ctx, chi.URLParam(r, "number"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	accrual.Requeue(*order)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/accrual"
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+	"github.com/fortuna91/ya_praktikum_final/internal/luhn"
+	"github.com/fortuna91/ya_praktikum_final/internal/tracing"
+)
+
+var BatchMaxOrders = 1000
+
+// UploadOrders accepts many order numbers at once, either as a JSON array or as
+// newline-separated text, and reports the result for each number.
+func UploadOrders(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	token, _ := auth.GetTokenFromHeader(r)
+	login, _ := auth.ParseToken(token)
+	user := dbStorage.GetUser(ctx, login)
+
+	respBody, err := body.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	partner := partnerFromRequest(r)
+	numbers, errParse := parseOrderNumbers(r.Header.Get("Content-Type"), respBody)
+	if errParse != nil {
+		writeError(w, r, errParse)
+		return
+	}
+	if len(numbers) == 0 {
+		writeError(w, r, apierror.Validation(apierror.FieldError{Field: "orders", Message: "is empty"}))
+		return
+	}
+	if len(numbers) > BatchMaxOrders {
+		writeError(w, r, apierror.Validation(apierror.FieldError{Field: "orders",
+			Message: "must contain at most " + strconv.Itoa(BatchMaxOrders) + " numbers"}))
+		return
+	}
+
+	results := make([]entity.BatchOrderResult, len(numbers))
+	var valid []string
+	seen := make(map[string]bool, len(numbers))
+	for i, number := range numbers {
+		number = luhn.Normalize(number)
+		results[i].Number = number
+		if !luhn.Valid(number) {
+			results[i].Status = entity.BatchInvalid
+			continue
+		}
+		if !seen[number] {
+			seen[number] = true
+			valid = append(valid, number)
+		}
+	}
+
+	var statuses map[string]string
+	if len(valid) > 0 {
+		statuses, err = dbStorage.AddOrders(ctx, valid, user.ID, NewStatus, partner)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	status := http.StatusOK
+	enqueued := make(map[string]bool, len(valid))
+	for i := range results {
+		if results[i].Status == entity.BatchInvalid {
+			continue
+		}
+		results[i].Status = statuses[results[i].Number]
+		if results[i].Status != entity.BatchAccepted {
+			continue
+		}
+		if enqueued[results[i].Number] {
+			// the number is repeated in the batch, the first one has added it
+			results[i].Status = entity.BatchAlreadyYours
+			continue
+		}
+		enqueued[results[i].Number] = true
+		accrual.Enqueue(entity.Order{ID: results[i].Number, UserID: user.ID, Status: NewStatus, Partner: partner,
+			TraceParent: tracing.TraceParent(ctx)})
+		status = http.StatusAccepted
+	}
+
+	writeJSONStatus(w, r, status, results)
+}
+
+func parseOrderNumbers(contentType string, data []byte) ([]string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/json" {
+		var items []json.RawMessage
+		if err := body.DecodeJSON(data, &items); err != nil {
+			return nil, apierror.Validation(apierror.FieldError{Field: "orders", Message: "must be an array of order numbers"})
+		}
+		// an item that is not a number is reported as invalid, the others are still taken
+		result := make([]string, len(items))
+		for i, item := range items {
+			var number string
+			if err := json.Unmarshal(item, &number); err != nil {
+				number = string(item)
+			}
+			result[i] = number
+		}
+		return result, nil
+	}
+
+	var numbers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			numbers = append(numbers, line)
+		}
+	}
+	return numbers, nil
+}
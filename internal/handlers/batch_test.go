@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+)
+
+func TestParseOrderNumbers(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		data        string
+		want        []string
+	}{
+		{"json numbers", "application/json", `[79927398713, 18]`, []string{"79927398713", "18"}},
+		{"json strings", "application/json; charset=utf-8", `["79927398713", "4561 2612 1234 5467"]`,
+			[]string{"79927398713", "4561 2612 1234 5467"}},
+		{"json bad items", "application/json", `[79927398713, "abc", true, 1.5, null, {"a":1}]`,
+			[]string{"79927398713", "abc", "true", "1.5", "", `{"a":1}`}},
+		{"json empty", "application/json", `[]`, []string{}},
+		{"text", "text/plain", "79927398713\r\n\n abc \n18", []string{"79927398713", "abc", "18"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOrderNumbers(tt.contentType, []byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseOrderNumbers() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOrderNumbersNotAnArray(t *testing.T) {
+	for _, data := range []string{`{"orders":[18]}`, `79927398713`, `[18`, `[18] [26]`} {
+		_, err := parseOrderNumbers("application/json", []byte(data))
+		var apiErr *apierror.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != apierror.CodeValidationFailed {
+			t.Errorf("parseOrderNumbers(%s) = %v, want a validation error", data, err)
+		}
+	}
+}
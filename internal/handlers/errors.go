@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/db"
+)
+
+var (
+	ErrBadRequest              = errors.New("wrong request")
+	ErrUnknownLogin            = errors.New("login doesn't exist")
+	ErrWrongPassword           = errors.New("wrong password")
+	ErrInvalidOrderNumber      = errors.New("wrong order number")
+	ErrOrderOwnedByAnotherUser = errors.New("order belongs to another user")
+	ErrOrderNotFound           = errors.New("order not found")
+)
+
+type errorMapping struct {
+	err    error
+	status int
+	code   string
+}
+
+// errorMappings is the single place where domain errors get their HTTP status and code.
+var errorMappings = []errorMapping{
+	{ErrBadRequest, http.StatusBadRequest, apierror.CodeBadRequest},
+	{ErrUnknownLogin, http.StatusUnauthorized, apierror.CodeUnknownLogin},
+	{ErrWrongPassword, http.StatusUnauthorized, apierror.CodeWrongPassword},
+	{ErrInvalidOrderNumber, http.StatusUnprocessableEntity, apierror.CodeInvalidOrderNumber},
+	{ErrOrderOwnedByAnotherUser, http.StatusConflict, apierror.CodeOrderOwnedByAnotherUser},
+	{ErrOrderNotFound, http.StatusNotFound, apierror.CodeOrderNotFound},
+	{body.ErrTooLarge, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge},
+	{body.ErrCorrupt, http.StatusBadRequest, apierror.CodeBadRequest},
+	{body.ErrMalformedJSON, http.StatusBadRequest, apierror.CodeBadRequest},
+	{body.ErrUnknownField, http.StatusBadRequest, apierror.CodeBadRequest},
+	{db.ErrLoginExists, http.StatusConflict, apierror.CodeLoginExists},
+	{db.ErrOrderNotFound, http.StatusNotFound, apierror.CodeOrderNotFound},
+	{db.ErrOrderNotFailed, http.StatusConflict, apierror.CodeOrderNotFailed},
+	{db.ErrInsufficientFunds, http.StatusPaymentRequired, apierror.CodeInsufficientFunds},
+	{db.ErrWebhookNotFound, http.StatusNotFound, apierror.CodeWebhookNotFound},
+	{db.ErrDeliveryNotFound, http.StatusNotFound, apierror.CodeDeliveryNotFound},
+	{db.ErrPartnerExists, http.StatusConflict, apierror.CodePartnerExists},
+	{db.ErrPartnerNotFound, http.StatusNotFound, apierror.CodePartnerNotFound},
+	{db.ErrPromoExists, http.StatusConflict, apierror.CodePromoExists},
+	{db.ErrPromoNotFound, http.StatusNotFound, apierror.CodePromoNotFound},
+	{db.ErrPromoNotActive, http.StatusUnprocessableEntity, apierror.CodePromoNotActive},
+	{db.ErrPromoExpired, http.StatusUnprocessableEntity, apierror.CodePromoExpired},
+	{db.ErrPromoExhausted, http.StatusConflict, apierror.CodePromoExhausted},
+	{db.ErrPromoLimitReached, http.StatusConflict, apierror.CodePromoLimitReached},
+}
+
+// ToAPIError converts an error into a problem. Unknown errors become internal errors
+// and their text never reaches the client.
+func ToAPIError(err error) *apierror.Error {
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	var fieldErr *body.FieldError
+	if errors.As(err, &fieldErr) {
+		return apierror.Validation(apierror.FieldError{Field: fieldErr.Field, Message: fieldErr.Message})
+	}
+	for _, m := range errorMappings {
+		if errors.Is(err, m.err) {
+			return apierror.New(m.status, m.code, m.err.Error())
+		}
+	}
+	return apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "")
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := ToAPIError(err)
+	if apiErr.Status >= http.StatusInternalServerError {
+		log.Ctx(r.Context()).Error().Msgf("Request %s %s failed: %v", r.Method, r.URL.Path, err)
+	}
+	apierror.Write(w, r, apiErr)
+}
+
+func internalError(w http.ResponseWriter, r *http.Request) {
+	apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, ""))
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/db"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+		detail string
+	}{
+		{ErrBadRequest, http.StatusBadRequest, apierror.CodeBadRequest, "wrong request"},
+		{ErrUnknownLogin, http.StatusUnauthorized, apierror.CodeUnknownLogin, "login doesn't exist"},
+		{ErrWrongPassword, http.StatusUnauthorized, apierror.CodeWrongPassword, "wrong password"},
+		{ErrInvalidOrderNumber, http.StatusUnprocessableEntity, apierror.CodeInvalidOrderNumber, "wrong order number"},
+		{ErrOrderOwnedByAnotherUser, http.StatusConflict, apierror.CodeOrderOwnedByAnotherUser, "order belongs to another user"},
+		{ErrOrderNotFound, http.StatusNotFound, apierror.CodeOrderNotFound, "order not found"},
+		{body.ErrTooLarge, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, "body is too large"},
+		{body.ErrCorrupt, http.StatusBadRequest, apierror.CodeBadRequest, "corrupt compressed body"},
+		{body.ErrMalformedJSON, http.StatusBadRequest, apierror.CodeBadRequest, "malformed JSON"},
+		{body.ErrUnknownField, http.StatusBadRequest, apierror.CodeBadRequest, "unknown field in JSON"},
+		{db.ErrLoginExists, http.StatusConflict, apierror.CodeLoginExists, "login already exists"},
+		{db.ErrOrderNotFound, http.StatusNotFound, apierror.CodeOrderNotFound, "order not found"},
+		{db.ErrOrderNotFailed, http.StatusConflict, apierror.CodeOrderNotFailed, "order is not dead-lettered"},
+		{db.ErrInsufficientFunds, http.StatusPaymentRequired, apierror.CodeInsufficientFunds, "not enough balance"},
+		{db.ErrWebhookNotFound, http.StatusNotFound, apierror.CodeWebhookNotFound, db.ErrWebhookNotFound.Error()},
+		{db.ErrDeliveryNotFound, http.StatusNotFound, apierror.CodeDeliveryNotFound, db.ErrDeliveryNotFound.Error()},
+		{db.ErrPartnerExists, http.StatusConflict, apierror.CodePartnerExists, db.ErrPartnerExists.Error()},
+		{db.ErrPartnerNotFound, http.StatusNotFound, apierror.CodePartnerNotFound, db.ErrPartnerNotFound.Error()},
+		{db.ErrPromoExists, http.StatusConflict, apierror.CodePromoExists, "promo code already exists"},
+		{db.ErrPromoNotFound, http.StatusNotFound, apierror.CodePromoNotFound, "promo code not found"},
+		{db.ErrPromoNotActive, http.StatusUnprocessableEntity, apierror.CodePromoNotActive, "promo code is not active yet"},
+		{db.ErrPromoExpired, http.StatusUnprocessableEntity, apierror.CodePromoExpired, "promo code has expired"},
+		{db.ErrPromoExhausted, http.StatusConflict, apierror.CodePromoExhausted, "promo code has been fully redeemed"},
+		{db.ErrPromoLimitReached, http.StatusConflict, apierror.CodePromoLimitReached, "promo code redemption limit for user reached"},
+		// wrapped errors keep their mapping
+		{fmt.Errorf("redeem: %w", db.ErrPromoExpired), http.StatusUnprocessableEntity, apierror.CodePromoExpired, "promo code has expired"},
+		// the text of unknown errors never reaches the client
+		{&db.ErrorDB{Err: errors.New("password=secret")}, http.StatusInternalServerError, apierror.CodeInternal, ""},
+		{apierror.New(http.StatusForbidden, apierror.CodeForbidden, "admins only"), http.StatusForbidden, apierror.CodeForbidden, "admins only"},
+	}
+	covered := make(map[error]bool)
+	for _, tt := range tests {
+		covered[tt.err] = true
+		t.Run(tt.code+"/"+tt.err.Error(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, httptest.NewRequest(http.MethodGet, "/api/user/orders", nil), tt.err)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Type"); got != apierror.ContentType {
+				t.Errorf("Content-Type = %q, want %q", got, apierror.ContentType)
+			}
+			var problem apierror.Error
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			want := apierror.Error{
+				Type:     "/errors/" + tt.code,
+				Title:    http.StatusText(tt.status),
+				Status:   tt.status,
+				Code:     tt.code,
+				Detail:   tt.detail,
+				Instance: "/api/user/orders",
+			}
+			if problem.Type != want.Type || problem.Title != want.Title || problem.Status != want.Status ||
+				problem.Code != want.Code || problem.Detail != want.Detail || problem.Instance != want.Instance {
+				t.Errorf("body = %+v, want %+v", problem, want)
+			}
+		})
+	}
+	for _, m := range errorMappings {
+		if !covered[m.err] {
+			t.Errorf("no test case for %q", m.err)
+		}
+	}
+}
+
+func TestWriteErrorValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want []apierror.FieldError
+	}{
+		{"field error", &body.FieldError{Field: "sum", Message: "must be float32"},
+			[]apierror.FieldError{{Field: "sum", Message: "must be float32"}}},
+		{"validation", apierror.Validation(apierror.FieldError{Field: "order", Message: "is required"}),
+			[]apierror.FieldError{{Field: "order", Message: "is required"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", nil), tt.err)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			var problem apierror.Error
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Code != apierror.CodeValidationFailed {
+				t.Errorf("code = %q, want %q", problem.Code, apierror.CodeValidationFailed)
+			}
+			if len(problem.Errors) != len(tt.want) || problem.Errors[0] != tt.want[0] {
+				t.Errorf("errors = %+v, want %+v", problem.Errors, tt.want)
+			}
+		})
+	}
+}
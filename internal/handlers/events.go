@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/events"
+)
+
+var EventsHeartbeat = 15 * time.Second
+
+var eventsClosed = make(chan struct{})
+var closeEventsOnce sync.Once
+
+// CloseEvents ends all open streams, so they don't hold up the server shutdown. Clients
+// reconnect to another instance and resume with Last-Event-ID.
+func CloseEvents() {
+	closeEventsOnce.Do(func() {
+		close(eventsClosed)
+	})
+}
+
+// Events streams order and balance changes of the user as Server-Sent Events.
+func Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		internalError(w, r)
+		return
+	}
+
+	token, _ := auth.GetTokenFromHeader(r)
+	login, _ := auth.ParseToken(token)
+	user := dbStorage.GetUser(r.Context(), login)
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	lastID, _ := strconv.ParseInt(lastEventID, 10, 64)
+
+	stream, missed, unsubscribe := events.Default.Subscribe(user.ID, lastID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(EventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-eventsClosed:
+			return
+		case event := <-stream:
+			if err := writeEvent(w, event); err != nil {
+				log.Ctx(r.Context()).Warn().Msgf("Couldn't send event to user %d: %v", user.ID, err)
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event events.Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
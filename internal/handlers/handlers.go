@@ -3,20 +3,22 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/theplant/luhn"
 	"net/http"
-	"strconv"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog/log"
 
 	"github.com/fortuna91/ya_praktikum_final/internal/accrual"
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
 	"github.com/fortuna91/ya_praktikum_final/internal/auth"
 	"github.com/fortuna91/ya_praktikum_final/internal/body"
 	"github.com/fortuna91/ya_praktikum_final/internal/db"
 	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+	"github.com/fortuna91/ya_praktikum_final/internal/luhn"
+	"github.com/fortuna91/ya_praktikum_final/internal/metrics"
+	"github.com/fortuna91/ya_praktikum_final/internal/tracing"
 )
 
 var HashKey string
@@ -24,6 +26,9 @@ var HashKey string
 var dbStorage *db.DBStorage
 var ContextCancelTimeout time.Duration
 
+// Migrate makes PrepareDB create and upgrade the tables.
+var Migrate = true
+
 const NewStatus = "NEW"
 
 func PrepareDB(dbAddress string) error {
@@ -38,8 +43,10 @@ func PrepareDB(dbAddress string) error {
 	if err != nil {
 		return err
 	}
-	// error
-	dbStorage.Create(ctx)
+	if Migrate {
+		// error
+		dbStorage.Create(ctx)
+	}
 	return nil
 }
 
@@ -51,36 +58,42 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
 	defer cancel()
 	r.Header.Add("Content-Type", "application/json; charset=utf-8")
-	respBody := body.GetBody(r.Body)
-	if respBody == nil {
-		http.Error(w, "Couldn't read body", http.StatusInternalServerError)
+	respBody, err := body.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	userRequest := entity.User{}
-	if errJSON := json.Unmarshal(*respBody, &userRequest); errJSON != nil {
-		http.Error(w, "Wrong request", http.StatusBadRequest)
+	userRequest := entity.Credentials{}
+	if errJSON := body.DecodeJSON(respBody, &userRequest); errJSON != nil {
+		writeError(w, r, errJSON)
+		return
+	}
+	if errValidation := validateCredentials(&userRequest); errValidation != nil {
+		writeError(w, r, errValidation)
 		return
 	}
 	userDB := dbStorage.GetUser(ctx, userRequest.Login)
 	if userDB != nil {
-		http.Error(w, "Login exists", http.StatusConflict)
+		writeError(w, r, db.ErrLoginExists)
 		return
 	}
 	if errAdd := dbStorage.AddUser(ctx, userRequest.Login, auth.CalcHash(HashKey, userRequest.Password)); errAdd != nil {
-		http.Error(w, errAdd.Error(), http.StatusInternalServerError)
+		writeError(w, r, errAdd)
 		return
 	}
 	newUser := dbStorage.GetUser(ctx, userRequest.Login)
-	var errDB *db.ErrorDB
-	if err := dbStorage.AddBalance(ctx, newUser.ID); errors.As(err, &errDB) {
-		log.Error().Msgf("Couldn't add balance: %v", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+	if newUser == nil {
+		internalError(w, r)
+		return
+	}
+	if err := dbStorage.AddBalance(ctx, newUser.ID); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	signedToken, err := auth.SetToken(newUser)
 	if err != nil {
-		http.Error(w, "Error sending the response", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	w.Header().Set("Authorization", "Bearer "+signedToken)
@@ -92,29 +105,38 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 	r.Header.Add("Content-Type", "application/json; charset=utf-8")
 
-	respBody := body.GetBody(r.Body)
-	if respBody == nil {
-		http.Error(w, "Couldn't read body", http.StatusInternalServerError)
+	respBody, err := body.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	userRequest := entity.Credentials{}
+	if errJSON := body.DecodeJSON(respBody, &userRequest); errJSON != nil {
+		writeError(w, r, errJSON)
 		return
 	}
-	userRequest := entity.User{}
-	if errJSON := json.Unmarshal(*respBody, &userRequest); errJSON != nil {
-		http.Error(w, "Wrong request", http.StatusBadRequest)
+	if errRequired := requireFields(
+		requiredField{"login", userRequest.Login != ""},
+		requiredField{"password", userRequest.Password != ""},
+	); errRequired != nil {
+		writeError(w, r, errRequired)
 		return
 	}
 	userDB := dbStorage.GetUser(ctx, userRequest.Login)
 	if userDB == nil {
-		http.Error(w, "Login doesn't exist", http.StatusUnauthorized)
+		metrics.LoginFailures.WithLabelValues("unknown_login").Inc()
+		writeError(w, r, ErrUnknownLogin)
 		return
 	}
 	if auth.CalcHash(HashKey, userRequest.Password) != userDB.Password {
-		http.Error(w, "Wrong password", http.StatusUnauthorized)
+		metrics.LoginFailures.WithLabelValues("wrong_password").Inc()
+		writeError(w, r, ErrWrongPassword)
 		return
 	}
 
-	signedToken, err := auth.SetToken(&userRequest)
+	signedToken, err := auth.SetToken(userDB)
 	if err != nil {
-		http.Error(w, "Error sending the response", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	w.Header().Set("Authorization", "Bearer "+signedToken)
@@ -129,31 +151,33 @@ func UploadOrder(w http.ResponseWriter, r *http.Request) {
 	token, _ := auth.GetTokenFromHeader(r)
 	login, _ := auth.ParseToken(token)
 	user := dbStorage.GetUser(ctx, login)
-	orderID := string(*body.GetBody(r.Body))
-	intOrderID, err := strconv.ParseInt(orderID, 10, 64)
+	respBody, err := body.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "wrong order format", http.StatusUnprocessableEntity)
+		writeError(w, r, err)
 		return
 	}
-	if !luhn.Valid(int(intOrderID)) {
-		http.Error(w, "wrong order format, luhn", http.StatusUnprocessableEntity)
+	partner := partnerFromRequest(r)
+	orderID := luhn.Normalize(string(respBody))
+	if !luhn.Valid(orderID) {
+		writeError(w, r, ErrInvalidOrderNumber)
 		return
 	}
 	orderDB := dbStorage.GetOrder(ctx, orderID)
 	if orderDB != nil {
 		if orderDB.UserID != user.ID {
-			http.Error(w, "order belongs to another user", http.StatusConflict)
+			writeError(w, r, ErrOrderOwnedByAnotherUser)
 		} else {
-			log.Warn().Msgf("Order %s exists\n", orderID)
+			log.Ctx(r.Context()).Warn().Msgf("Order %s exists\n", orderID)
 			w.WriteHeader(http.StatusOK)
 		}
 		return
 	}
-	if errAdd := dbStorage.AddOrder(ctx, orderID, user.ID, NewStatus); errAdd != nil {
-		http.Error(w, "internal error", http.StatusInternalServerError)
+	if errAdd := dbStorage.AddOrder(ctx, orderID, user.ID, NewStatus, partner); errAdd != nil {
+		writeError(w, r, errAdd)
 		return
 	}
-	accrual.QueueCh <- *dbStorage.GetOrder(ctx, orderID)
+	accrual.Enqueue(entity.Order{ID: orderID, UserID: user.ID, Status: NewStatus, Partner: partner,
+		TraceParent: tracing.TraceParent(ctx)})
 	w.WriteHeader(http.StatusAccepted)
 }
 
@@ -165,59 +189,72 @@ func GetOrders(w http.ResponseWriter, r *http.Request) {
 	token, _ := auth.GetTokenFromHeader(r)
 	login, _ := auth.ParseToken(token)
 	user := dbStorage.GetUser(ctx, login)
-	ordersDB, err := dbStorage.GetOrders(ctx, user.ID)
-	var errDB *db.ErrorDB
-	if errors.As(err, &errDB) {
-		http.Error(w, "Error getting orders", http.StatusInternalServerError)
+	filter, errFilter := parseOrdersFilter(r.URL.Query())
+	if errFilter != nil {
+		writeError(w, r, errFilter)
 		return
 	}
-	if ordersDB == nil {
-		log.Warn().Msg("No orders for user")
-		w.WriteHeader(http.StatusNoContent)
-		return
+	pageLimit := filter.Limit
+	if pageLimit > 0 {
+		// one more order tells whether there is a next page
+		filter.Limit++
 	}
-	bodyResp, err := json.Marshal(ordersDB)
+	ordersDB, err := dbStorage.GetOrdersPage(ctx, user.ID, filter)
 	if err != nil {
-		log.Error().Msgf("Cannot convert Orders to JSON: %v", err)
-		http.Error(w, "Error sending the response", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	_, errBody := w.Write(bodyResp)
-	if errBody != nil {
-		log.Error().Msgf("Error sending the response: %v\n", errBody)
-		http.Error(w, "Error sending the response", http.StatusInternalServerError)
+	if pageLimit > 0 && len(ordersDB) > pageLimit {
+		ordersDB = ordersDB[:pageLimit]
+		setNextPage(w, r, &ordersDB[pageLimit-1])
+	}
+	if ordersDB == nil {
+		log.Ctx(r.Context()).Warn().Msg("No orders for user")
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
+	writeJSON(w, r, ordersDB)
 }
 
-func GetBalance(w http.ResponseWriter, r *http.Request) {
+func GetOrder(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
 	defer cancel()
 
 	token, _ := auth.GetTokenFromHeader(r)
 	login, _ := auth.ParseToken(token)
 	user := dbStorage.GetUser(ctx, login)
-	balanceDB := dbStorage.GetBalance(ctx, user.ID)
-	if balanceDB == nil {
-		log.Warn().Msg("No balance for user")
-		w.WriteHeader(http.StatusInternalServerError)
+	orderID := luhn.Normalize(chi.URLParam(r, "number"))
+	orderDB := dbStorage.GetOrder(ctx, orderID)
+	// someone else's order looks the same as a missing one
+	if orderDB == nil || orderDB.UserID != user.ID {
+		writeError(w, r, ErrOrderNotFound)
 		return
 	}
-	bodyResp, err := json.Marshal(balanceDB)
+	history, err := dbStorage.GetOrderHistory(ctx, orderID)
 	if err != nil {
-		log.Error().Msgf("Cannot convert Balance to JSON: %v", err)
-		http.Error(w, "Error sending the response", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	_, errBody := w.Write(bodyResp)
-	if errBody != nil {
-		log.Error().Msgf("Error sending the response: %v\n", errBody)
-		http.Error(w, "Error sending the response", http.StatusInternalServerError)
+	if history == nil {
+		history = []entity.OrderStatusChange{}
+	}
+	writeJSON(w, r, entity.OrderDetails{Order: *orderDB, Timeline: history})
+}
+
+func GetBalance(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	token, _ := auth.GetTokenFromHeader(r)
+	login, _ := auth.ParseToken(token)
+	user := dbStorage.GetUser(ctx, login)
+	balanceDB := dbStorage.GetBalance(ctx, user.ID)
+	if balanceDB == nil {
+		log.Ctx(r.Context()).Warn().Msg("No balance for user")
+		internalError(w, r)
 		return
 	}
+	writeJSON(w, r, balanceDB)
 }
 
 func Withdraw(w http.ResponseWriter, r *http.Request) {
@@ -229,47 +266,37 @@ func Withdraw(w http.ResponseWriter, r *http.Request) {
 	login, _ := auth.ParseToken(token)
 	user := dbStorage.GetUser(ctx, login)
 
-	respBody := body.GetBody(r.Body)
-	if respBody == nil {
-		http.Error(w, "Couldn't read body", http.StatusInternalServerError)
+	respBody, err := body.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	withdrawalRequest := entity.Withdrawals{}
-	if errJSON := json.Unmarshal(*respBody, &withdrawalRequest); errJSON != nil {
-		http.Error(w, errJSON.Error(), http.StatusBadRequest) //"wrong request",
-		return
-	}
-	currBalance := dbStorage.GetBalance(ctx, user.ID)
-	if currBalance == nil {
-		log.Warn().Msg("Couldn't find balance")
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
-	if currBalance.Current < withdrawalRequest.Sum {
-		log.Error().Msgf("Not enough balance: %f < %f\n", currBalance.Current, withdrawalRequest.Sum)
-		http.Error(w, "not enough balance", http.StatusPaymentRequired)
+	if errJSON := body.DecodeJSON(respBody, &withdrawalRequest); errJSON != nil {
+		writeError(w, r, errJSON)
 		return
 	}
-	intOrderID, err := strconv.Atoi(withdrawalRequest.OrderID)
-	if err != nil {
-		http.Error(w, "wrong order format", http.StatusUnprocessableEntity)
+	if errRequired := requireFields(
+		requiredField{"order", withdrawalRequest.OrderID != ""},
+		requiredField{"sum", withdrawalRequest.Sum != 0},
+	); errRequired != nil {
+		writeError(w, r, errRequired)
 		return
 	}
-	if !luhn.Valid(intOrderID) {
-		http.Error(w, "wrong order format", http.StatusUnprocessableEntity)
+	if withdrawalRequest.Sum < 0 {
+		writeError(w, r, apierror.Validation(apierror.FieldError{Field: "sum", Message: "must be positive"}))
 		return
 	}
-	if err := dbStorage.AddWithdrawal(ctx, user.ID, withdrawalRequest.Sum, withdrawalRequest.OrderID); err != nil {
-		log.Error().Msgf("Couldn't add withdrawal %v\n", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+	withdrawalRequest.OrderID = luhn.Normalize(withdrawalRequest.OrderID)
+	if !luhn.Valid(withdrawalRequest.OrderID) {
+		writeError(w, r, ErrInvalidOrderNumber)
 		return
 	}
-	var errDB *db.ErrorDB
-	if err := dbStorage.Withdraw(ctx, user.ID, withdrawalRequest.Sum); errors.As(err, &errDB) {
-		log.Error().Msgf("Couldn't update balance %v\n", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+	if err := dbStorage.Withdraw(ctx, user.ID, withdrawalRequest.Sum, withdrawalRequest.OrderID); err != nil {
+		writeError(w, r, err)
 		return
 	}
+	metrics.PointsWithdrawn.Add(float64(withdrawalRequest.Sum))
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -283,27 +310,31 @@ func GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 	user := dbStorage.GetUser(ctx, login)
 	withdrawalsDB, err := dbStorage.GetWithdrawals(ctx, user.ID)
 	if err != nil {
-		var errDB *db.ErrorDB
-		if errors.As(err, &errDB) {
-			log.Error().Msg(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			log.Warn().Msg("No withdrawals for user")
-			w.WriteHeader(http.StatusNoContent)
-		}
+		writeError(w, r, err)
 		return
 	}
-	bodyResp, err := json.Marshal(withdrawalsDB)
-	if err != nil {
-		log.Error().Msgf("Cannot convert withdrawals to JSON: %v", err)
-		http.Error(w, "Error sending the response", http.StatusInternalServerError)
+	if withdrawalsDB == nil {
+		log.Ctx(r.Context()).Warn().Msg("No withdrawals for user")
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	_, errBody := w.Write(bodyResp)
-	if errBody != nil {
-		log.Error().Msgf("Error sending the response: %v\n", errBody)
-		http.Error(w, "Error sending the response", http.StatusInternalServerError)
+	writeJSON(w, r, withdrawalsDB)
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeJSONStatus(w, r, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	bodyResp, err := json.Marshal(v)
+	if err != nil {
+		log.Ctx(r.Context()).Error().Msgf("Cannot convert response to JSON: %v", err)
+		internalError(w, r)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if _, errBody := w.Write(bodyResp); errBody != nil {
+		log.Ctx(r.Context()).Error().Msgf("Error sending the response: %v\n", errBody)
+	}
 }
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+var orderStatuses = map[string]bool{
+	"NEW":        true,
+	"PROCESSING": true,
+	"INVALID":    true,
+	"PROCESSED":  true,
+	"FAILED":     true,
+}
+
+// parseOrdersFilter reads limit, cursor, status, from, to and order query parameters.
+// Without parameters the filter selects all orders in upload order.
+func parseOrdersFilter(query url.Values) (*entity.OrdersFilter, *apierror.Error) {
+	filter := entity.OrdersFilter{}
+	var fields []apierror.FieldError
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			fields = append(fields, apierror.FieldError{Field: "limit", Message: "must be from 1 to " + strconv.Itoa(maxPageLimit)})
+		}
+		filter.Limit = n
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			fields = append(fields, apierror.FieldError{Field: "cursor", Message: "is malformed"})
+		}
+		filter.After = after
+		if filter.Limit == 0 {
+			filter.Limit = defaultPageLimit
+		}
+	}
+	for _, statuses := range query["status"] {
+		for _, status := range strings.Split(statuses, ",") {
+			status = strings.ToUpper(strings.TrimSpace(status))
+			if !orderStatuses[status] {
+				fields = append(fields, apierror.FieldError{Field: "status", Message: "unknown status " + status})
+				continue
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+	for name, dst := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				fields = append(fields, apierror.FieldError{Field: name, Message: "must be an RFC 3339 time"})
+				continue
+			}
+			t = t.UTC()
+			*dst = &t
+		}
+	}
+	switch strings.ToLower(query.Get("order")) {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		fields = append(fields, apierror.FieldError{Field: "order", Message: "must be asc or desc"})
+	}
+
+	if fields != nil {
+		return nil, apierror.Validation(fields...)
+	}
+	return &filter, nil
+}
+
+func encodeCursor(order *entity.Order) string {
+	cursor, _ := json.Marshal(entity.OrderCursor{UploadedAt: order.UploadedAt, ID: order.ID})
+	return base64.RawURLEncoding.EncodeToString(cursor)
+}
+
+func decodeCursor(cursor string) (*entity.OrderCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	after := entity.OrderCursor{}
+	if err = json.Unmarshal(data, &after); err != nil {
+		return nil, err
+	}
+	return &after, nil
+}
+
+// setNextPage adds the Link header and X-Next-Cursor pointing to the page after the last order.
+func setNextPage(w http.ResponseWriter, r *http.Request, last *entity.Order) {
+	cursor := encodeCursor(last)
+	next := *r.URL
+	query := next.Query()
+	query.Set("cursor", cursor)
+	next.RawQuery = query.Encode()
+	w.Header().Set("Link", "<"+next.RequestURI()+`>; rel="next"`)
+	w.Header().Set("X-Next-Cursor", cursor)
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+)
+
+// PartnerKeyHeader carries the API key of a partner shop that submits orders on behalf of
+// the user. The partner decides which webhooks get the order events and which accrual
+// provider calculates the order, so it is never taken from the client as is.
+const PartnerKeyHeader = "X-Partner-Key"
+
+type partnerContextKey struct{}
+
+// WithPartner marks the request as sent by the authenticated partner.
+func WithPartner(ctx context.Context, partner string) context.Context {
+	return context.WithValue(ctx, partnerContextKey{}, partner)
+}
+
+// partnerFromRequest returns the authenticated partner of the request, or "".
+func partnerFromRequest(r *http.Request) string {
+	partner, _ := r.Context().Value(partnerContextKey{}).(string)
+	return partner
+}
+
+// AuthenticatePartner returns the partner the API key belongs to.
+func AuthenticatePartner(ctx context.Context, key string) (string, error) {
+	return dbStorage.GetPartnerByKey(ctx, auth.CalcHash(HashKey, key))
+}
+
+type partnerKey struct {
+	Partner string `json:"partner"`
+	Key     string `json:"key,omitempty"`
+}
+
+func newPartnerKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// AddPartner registers a partner shop. The API key is shown only once.
+func AddPartner(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	respBody, err := body.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	partner := partnerKey{}
+	if errJSON := body.DecodeJSON(respBody, &partner); errJSON != nil {
+		writeError(w, r, errJSON)
+		return
+	}
+	if partner.Partner == "" || len(partner.Partner) > partnerMaxLength || partner.Key != "" {
+		writeError(w, r, apierror.Validation(apierror.FieldError{Field: "partner",
+			Message: "is required and must be at most " + strconv.Itoa(partnerMaxLength) + " characters long"}))
+		return
+	}
+	if partner.Key, err = newPartnerKey(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err = dbStorage.AddPartner(ctx, partner.Partner, auth.CalcHash(HashKey, partner.Key)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSONStatus(w, r, http.StatusCreated, partner)
+}
+
+// RotatePartnerKey issues a new API key to the partner, the old one stops working.
+func RotatePartnerKey(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	partner := partnerKey{Partner: chi.URLParam(r, "name")}
+	var err error
+	if partner.Key, err = newPartnerKey(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err = dbStorage.RotatePartnerKey(ctx, partner.Partner, auth.CalcHash(HashKey, partner.Key)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, partner)
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+	"github.com/fortuna91/ya_praktikum_final/internal/metrics"
+)
+
+func AddPromo(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	respBody, err := body.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	promo := entity.Promo{}
+	if errJSON := body.DecodeJSON(respBody, &promo); errJSON != nil {
+		writeError(w, r, errJSON)
+		return
+	}
+	if promo.Mode == "" {
+		promo.Mode = db.PromoMultiUse
+	}
+	if promo.Code == "" || promo.Points <= 0 || promo.TotalLimit < 0 || promo.PerUserLimit < 0 ||
+		(promo.Mode != db.PromoSingleUse && promo.Mode != db.PromoMultiUse) {
+		writeError(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "wrong promo"))
+		return
+	}
+	if promo.ValidFrom != nil && promo.ValidUntil != nil && promo.ValidUntil.Before(*promo.ValidFrom) {
+		writeError(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "wrong promo validity window"))
+		return
+	}
+	if promo.Mode == db.PromoSingleUse {
+		promo.TotalLimit = 1
+	}
+
+	if err := dbStorage.AddPromo(ctx, &promo); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func GetPromos(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	promos, err := dbStorage.GetPromos(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if promos == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, promos)
+}
+
+func RedeemPromo(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	token, _ := auth.GetTokenFromHeader(r)
+	login, _ := auth.ParseToken(token)
+	user := dbStorage.GetUser(ctx, login)
+
+	respBody, err := body.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	redeemRequest := entity.PromoRedemption{}
+	if errJSON := body.DecodeJSON(respBody, &redeemRequest); errJSON != nil {
+		writeError(w, r, errJSON)
+		return
+	}
+	if errRequired := requireFields(requiredField{"code", redeemRequest.Code != ""}); errRequired != nil {
+		writeError(w, r, errRequired)
+		return
+	}
+
+	promo, err := dbStorage.RedeemPromo(ctx, redeemRequest.Code, user.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	metrics.Credit(metrics.SourcePromo, promo.Points)
+	writeJSON(w, r, entity.PromoRedemption{Code: promo.Code, Points: promo.Points})
+}
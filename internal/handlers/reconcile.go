@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/reconcile"
+)
+
+const discrepanciesLimit = 1000
+
+func GetDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	discrepancies, err := dbStorage.GetDiscrepancies(ctx, discrepanciesLimit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if discrepancies == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, discrepancies)
+}
+
+// RunReconciliation checks recently processed orders right away and returns the report.
+// With ?dry_run=true nothing is written, with ?correct=true discrepancies are adjusted.
+func RunReconciliation(w http.ResponseWriter, r *http.Request) {
+	var options reconcile.Options
+	var fields []apierror.FieldError
+	for name, value := range map[string]*bool{"dry_run": &options.DryRun, "correct": &options.Correct} {
+		raw := r.URL.Query().Get(name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			fields = append(fields, apierror.FieldError{Field: name, Message: "must be true or false"})
+			continue
+		}
+		*value = parsed
+	}
+	if fields != nil {
+		writeError(w, r, apierror.Validation(fields...))
+		return
+	}
+
+	// a run asks the accrual system about every order, so it is not bound by the usual
+	// request timeout
+	writeJSON(w, r, reconcile.Check(r.Context(), dbStorage, options))
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+const (
+	loginMinLength    = 3
+	loginMaxLength    = 50
+	passwordMaxLength = 128
+)
+
+var PasswordMinLength = 6
+
+// validateCredentials checks the login and password policy for new users.
+// It returns nil when the credentials are acceptable.
+func validateCredentials(credentials *entity.Credentials) *apierror.Error {
+	var fields []apierror.FieldError
+
+	loginLength := utf8.RuneCountInString(credentials.Login)
+	switch {
+	case loginLength == 0:
+		fields = append(fields, apierror.FieldError{Field: "login", Message: "is required"})
+	case loginLength < loginMinLength || loginLength > loginMaxLength:
+		fields = append(fields, apierror.FieldError{Field: "login",
+			Message: fmt.Sprintf("must be from %d to %d characters long", loginMinLength, loginMaxLength)})
+	case strings.IndexFunc(credentials.Login, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0:
+		fields = append(fields, apierror.FieldError{Field: "login", Message: "must not contain spaces or control characters"})
+	}
+
+	passwordLength := utf8.RuneCountInString(credentials.Password)
+	switch {
+	case passwordLength == 0:
+		fields = append(fields, apierror.FieldError{Field: "password", Message: "is required"})
+	case passwordLength < PasswordMinLength || passwordLength > passwordMaxLength:
+		fields = append(fields, apierror.FieldError{Field: "password",
+			Message: fmt.Sprintf("must be from %d to %d characters long", PasswordMinLength, passwordMaxLength)})
+	case credentials.Password == credentials.Login:
+		fields = append(fields, apierror.FieldError{Field: "password", Message: "must differ from login"})
+	}
+
+	if fields != nil {
+		return apierror.Validation(fields...)
+	}
+	return nil
+}
+
+type requiredField struct {
+	name    string
+	present bool
+}
+
+func requireFields(fields ...requiredField) *apierror.Error {
+	var missing []apierror.FieldError
+	for _, field := range fields {
+		if !field.present {
+			missing = append(missing, apierror.FieldError{Field: field.name, Message: "is required"})
+		}
+	}
+	if missing != nil {
+		return apierror.Validation(missing...)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+	webhookmodule "github.com/fortuna91/ya_praktikum_final/internal/webhook"
+)
+
+const (
+	partnerMaxLength = 50
+	deliveriesLimit  = 100
+)
+
+var webhookEvents = map[string]bool{
+	entity.WebhookOrderProcessed:   true,
+	entity.WebhookBalanceWithdrawn: true,
+}
+
+// webhookOwner returns the user ID for user routes and nil for admin routes, which
+// manage partner webhooks.
+func webhookOwner(ctx context.Context, r *http.Request) *int64 {
+	if strings.HasPrefix(r.URL.Path, "/api/admin/") {
+		return nil
+	}
+	token, _ := auth.GetTokenFromHeader(r)
+	login, _ := auth.ParseToken(token)
+	user := dbStorage.GetUser(ctx, login)
+	return &user.ID
+}
+
+func AddWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	respBody, err := body.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	webhook := entity.Webhook{}
+	if errJSON := body.DecodeJSON(respBody, &webhook); errJSON != nil {
+		writeError(w, r, errJSON)
+		return
+	}
+	owner := webhookOwner(ctx, r)
+
+	var fields []apierror.FieldError
+	if errURL := webhookmodule.CheckURL(ctx, webhook.URL); errURL != nil {
+		fields = append(fields, apierror.FieldError{Field: "url", Message: errURL.Error()})
+	}
+	if len(webhook.Events) == 0 {
+		fields = append(fields, apierror.FieldError{Field: "events", Message: "is required"})
+	}
+	for _, event := range webhook.Events {
+		if !webhookEvents[event] {
+			fields = append(fields, apierror.FieldError{Field: "events", Message: "unknown event " + event})
+		}
+	}
+	if owner == nil && webhook.Partner == "" {
+		fields = append(fields, apierror.FieldError{Field: "partner", Message: "is required"})
+	}
+	if owner != nil && webhook.Partner != "" {
+		fields = append(fields, apierror.FieldError{Field: "partner", Message: "can be set by admins only"})
+	}
+	if len(webhook.Partner) > partnerMaxLength {
+		fields = append(fields, apierror.FieldError{Field: "partner",
+			Message: "must be at most " + strconv.Itoa(partnerMaxLength) + " characters long"})
+	}
+	if fields != nil {
+		writeError(w, r, apierror.Validation(fields...))
+		return
+	}
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	if err = dbStorage.AddWebhook(ctx, owner, &webhook); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// the secret is shown only once
+	writeJSONStatus(w, r, http.StatusCreated, webhook)
+}
+
+func GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	webhooks, err := dbStorage.GetWebhooks(ctx, webhookOwner(ctx, r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if webhooks == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, webhooks)
+}
+
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, r, db.ErrWebhookNotFound)
+		return
+	}
+	if err = dbStorage.DeleteWebhook(ctx, webhookOwner(ctx, r), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, r, db.ErrWebhookNotFound)
+		return
+	}
+	deliveries, err := dbStorage.GetWebhookDeliveries(ctx, webhookOwner(ctx, r), id, deliveriesLimit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if deliveries == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, deliveries)
+}
+
+func RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ContextCancelTimeout)
+	defer cancel()
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, r, db.ErrDeliveryNotFound)
+		return
+	}
+	if err = dbStorage.RedeliverWebhook(ctx, webhookOwner(ctx, r), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
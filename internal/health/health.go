@@ -0,0 +1,118 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Timeout bounds every check, so a hanging dependency doesn't hang the probe.
+var Timeout = 2 * time.Second
+
+// CheckFunc returns an error when the dependency is not healthy.
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name     string
+	critical bool
+	fn       CheckFunc
+}
+
+type CheckResult struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+var mu sync.RWMutex
+var checks []check
+var shuttingDown int32
+
+// Register adds a readiness check. A failed critical check makes the service not ready,
+// other checks are only reported.
+func Register(name string, critical bool, fn CheckFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks = append(checks, check{name: name, critical: critical, fn: fn})
+}
+
+// SetShuttingDown makes readiness fail, so orchestrators stop sending traffic while the
+// server drains.
+func SetShuttingDown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+}
+
+// Healthz reports that the process is alive and serving.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	write(w, http.StatusOK, Report{Status: StatusOK})
+}
+
+// Readyz runs all checks in parallel and reports each of them.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	report := Check(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	write(w, status, report)
+}
+
+func Check(ctx context.Context) Report {
+	mu.RLock()
+	registered := append([]check{}, checks...)
+	mu.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(registered)+1)}
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		report.Status = StatusFail
+		report.Checks["shutdown"] = CheckResult{Status: StatusFail, Critical: true, Error: "server is shutting down"}
+	}
+
+	results := make([]CheckResult, len(registered))
+	var wg sync.WaitGroup
+	for i, c := range registered {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, Timeout)
+			defer cancel()
+			start := time.Now()
+			err := c.fn(checkCtx)
+			results[i] = CheckResult{Status: StatusOK, Critical: c.critical, Duration: time.Since(start).String()}
+			if err != nil {
+				results[i].Status = StatusFail
+				results[i].Error = err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	for i, c := range registered {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != StatusOK && c.critical {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func write(w http.ResponseWriter, status int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,162 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Exit codes of the process.
+const (
+	ExitOK = 0
+	// ExitError means the service has failed or a component couldn't stop cleanly.
+	ExitError = 1
+	// ExitTimeout means the shutdown didn't finish within the deadline.
+	ExitTimeout = 2
+)
+
+// CloseTimeout bounds the OnClose hooks when the shutdown deadline has already passed.
+var CloseTimeout = 5 * time.Second
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Manager runs the background components of the service and shuts everything down in
+// order: OnStop hooks first, then the components started with Go are cancelled and
+// awaited, then OnClose hooks run. The whole shutdown must fit into the deadline; the
+// OnClose hooks run even when it doesn't, so buffers are flushed and connections closed.
+type Manager struct {
+	deadline time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	stops   []hook
+	closers []hook
+
+	failed   chan error
+	failOnce sync.Once
+}
+
+func New(deadline time.Duration) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{deadline: deadline, ctx: ctx, cancel: cancel, failed: make(chan error, 1)}
+}
+
+// Context is cancelled when the shutdown reaches the background components.
+func (m *Manager) Context() context.Context {
+	return m.ctx
+}
+
+// Go runs the component until its context is cancelled. The shutdown waits for it to return.
+func (m *Manager) Go(name string, fn func(ctx context.Context)) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		fn(m.ctx)
+		log.Info().Msgf("%s has stopped", name)
+	}()
+}
+
+// OnStop adds a hook run at the start of the shutdown, e.g. to stop accepting requests.
+func (m *Manager) OnStop(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stops = append(m.stops, hook{name: name, fn: fn})
+}
+
+// OnClose adds a hook run after all components have stopped, e.g. to close the DB pool.
+func (m *Manager) OnClose(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closers = append(m.closers, hook{name: name, fn: fn})
+}
+
+// Fail starts the shutdown because of a fatal error; the process then exits with ExitError.
+func (m *Manager) Fail(err error) {
+	m.failOnce.Do(func() {
+		m.failed <- err
+	})
+}
+
+// Wait blocks until one of the signals comes or Fail is called, shuts down and returns
+// the exit code.
+func (m *Manager) Wait(signals ...os.Signal) int {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, signals...)
+	defer signal.Stop(sigChan)
+
+	code := ExitOK
+	select {
+	case sig := <-sigChan:
+		log.Info().Msgf("Got %s, shutting down", sig)
+	case err := <-m.failed:
+		log.Error().Msgf("Shutting down after failure: %v", err)
+		code = ExitError
+	}
+	return m.Shutdown(code)
+}
+
+// Shutdown stops everything within the deadline and returns the exit code, which is code
+// unless the shutdown itself fails.
+func (m *Manager) Shutdown(code int) int {
+	ctx, cancel := context.WithTimeout(context.Background(), m.deadline)
+	defer cancel()
+
+	m.mu.Lock()
+	stops, closers := m.stops, m.closers
+	m.mu.Unlock()
+
+	if !m.run(ctx, stops) {
+		code = ExitError
+	}
+
+	m.cancel()
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Error().Msg("Components didn't stop before the shutdown deadline")
+	}
+
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	closeCtx := ctx
+	if timedOut {
+		var closeCancel context.CancelFunc
+		closeCtx, closeCancel = context.WithTimeout(context.Background(), CloseTimeout)
+		defer closeCancel()
+	}
+	if !m.run(closeCtx, closers) {
+		code = ExitError
+	}
+	if timedOut || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ExitTimeout
+	}
+	if code == ExitOK {
+		log.Info().Msg("Server was stopped correctly")
+	}
+	return code
+}
+
+func (m *Manager) run(ctx context.Context, hooks []hook) bool {
+	ok := true
+	for _, h := range hooks {
+		if err := h.fn(ctx); err != nil {
+			log.Error().Msgf("Couldn't stop %s: %v", h.name, err)
+			ok = false
+		}
+	}
+	return ok
+}
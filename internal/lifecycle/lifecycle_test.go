@@ -0,0 +1,79 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShutdownOrder(t *testing.T) {
+	m := New(time.Second)
+	var calls []string
+	m.OnStop("server", func(context.Context) error {
+		calls = append(calls, "stop")
+		return nil
+	})
+	stopped := make(chan struct{})
+	m.Go("worker", func(ctx context.Context) {
+		<-ctx.Done()
+		calls = append(calls, "worker")
+		close(stopped)
+	})
+	m.OnClose("db", func(context.Context) error {
+		<-stopped
+		calls = append(calls, "close")
+		return nil
+	})
+
+	if code := m.Shutdown(ExitOK); code != ExitOK {
+		t.Errorf("Shutdown() = %d, want %d", code, ExitOK)
+	}
+	if want := []string{"stop", "worker", "close"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestShutdownFailures(t *testing.T) {
+	m := New(time.Second)
+	m.OnStop("server", func(context.Context) error { return errors.New("busy") })
+	closed := false
+	m.OnClose("db", func(context.Context) error {
+		closed = true
+		return nil
+	})
+
+	if code := m.Shutdown(ExitOK); code != ExitError {
+		t.Errorf("Shutdown() = %d, want %d", code, ExitError)
+	}
+	if !closed {
+		t.Error("closer didn't run after a failed stop")
+	}
+}
+
+func TestShutdownTimeoutStillCloses(t *testing.T) {
+	m := New(50 * time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	m.Go("stuck worker", func(ctx context.Context) {
+		<-release
+	})
+	var closeErr error
+	closed := false
+	m.OnClose("db", func(ctx context.Context) error {
+		closed = true
+		closeErr = ctx.Err()
+		return nil
+	})
+
+	if code := m.Shutdown(ExitOK); code != ExitTimeout {
+		t.Errorf("Shutdown() = %d, want %d", code, ExitTimeout)
+	}
+	if !closed {
+		t.Fatal("closer didn't run after the deadline")
+	}
+	if closeErr != nil {
+		t.Errorf("closer got a done context: %v", closeErr)
+	}
+}
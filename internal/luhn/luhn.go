@@ -0,0 +1,43 @@
+package luhn
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Normalize removes all whitespace from the number, so "4561 2612 1234 5467\n" becomes
+// "4561261212345467".
+func Normalize(number string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, number)
+}
+
+// Valid reports whether number is a non-empty string of ASCII digits with a correct
+// Luhn check digit. The number may be of any length.
+func Valid(number string) bool {
+	if number == "" {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
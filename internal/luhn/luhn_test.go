@@ -0,0 +1,108 @@
+package luhn
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"0", true},
+		{"18", true},
+		{"79927398713", true},
+		{"4561261212345467", true},
+		{"4561261212345464", false},
+		{"", false},
+		{"-18", false},
+		{"1 8", false},
+		{"１８", false},
+		{"3" + strings.Repeat("0", 100), false},
+		{"9" + strings.Repeat("0", 99) + "1", true},
+	}
+	for _, tt := range tests {
+		if got := Valid(tt.number); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
+
+// validNumber is a random number of up to 100 digits with a correct check digit.
+type validNumber string
+
+func (validNumber) Generate(r *rand.Rand, size int) reflect.Value {
+	payload := make([]byte, r.Intn(100))
+	for i := range payload {
+		payload[i] = byte('0' + r.Intn(10))
+	}
+	return reflect.ValueOf(validNumber(string(payload) + checkDigit(string(payload))))
+}
+
+// checkDigit is the digit that makes payload+digit valid.
+func checkDigit(payload string) string {
+	for d := byte('0'); d <= '9'; d++ {
+		if Valid(payload + string(d)) {
+			return string(d)
+		}
+	}
+	panic("no check digit for " + payload)
+}
+
+func TestValidAfterNormalize(t *testing.T) {
+	spaces := []string{" ", "\t", "\n", "\r\n"}
+	property := func(number validNumber, seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		var spaced strings.Builder
+		for _, c := range string(number) {
+			if r.Intn(4) == 0 {
+				spaced.WriteString(spaces[r.Intn(len(spaces))])
+			}
+			spaced.WriteRune(c)
+		}
+		spaced.WriteString(spaces[r.Intn(len(spaces))])
+		normalized := Normalize(spaced.String())
+		return Valid(string(number)) && normalized == string(number) && Valid(normalized)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSingleDigitChangeBreaksValidity(t *testing.T) {
+	property := func(number validNumber, position uint, delta uint8) bool {
+		digits := []byte(number)
+		i := int(position % uint(len(digits)))
+		// a different digit, never the same one
+		digits[i] = '0' + (digits[i]-'0'+1+delta%9)%10
+		return !Valid(string(digits))
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func FuzzValid(f *testing.F) {
+	for _, seed := range []string{"0", "79927398713", "4561261212345467", "", "12a4", "٣"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, number string) {
+		valid := Valid(number)
+		if valid && strings.Trim(number, "0123456789") != "" {
+			t.Errorf("Valid(%q) accepted a non-digit", number)
+		}
+		if !valid {
+			return
+		}
+		last := len(number) - 1
+		for d := byte('0'); d <= '9'; d++ {
+			if d != number[last] && Valid(number[:last]+string(d)) {
+				t.Errorf("%q and %q are both valid", number, number[:last]+string(d))
+			}
+		}
+	})
+}
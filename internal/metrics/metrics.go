@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gophermart"
+
+// Registry holds all metrics of the service. It is not the global Prometheus registry, so
+// metrics of imported libraries don't leak in.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "http_requests_total", Help: "HTTP requests by route pattern and status code.",
+	}, []string{"method", "route", "code"})
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "http_request_duration_seconds", Help: "HTTP request latency by route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	AccrualInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "accrual_polls_in_flight", Help: "Requests to accrual providers in progress.",
+	})
+	AccrualDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Name: "accrual_queue_dropped_total", Help: "Orders left to reconciliation because the accrual queue was full.",
+	})
+	AccrualRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "accrual_rate_limited_total", Help: "429 responses of accrual providers.",
+	}, []string{"provider"})
+	AccrualRetryAfter = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "accrual_retry_after_seconds", Help: "Last Retry-After wait asked by accrual providers.",
+	}, []string{"provider"})
+	AccrualBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "accrual_breaker_state", Help: "Circuit breaker state: 0 closed, 1 open, 2 half-open.",
+	}, []string{"provider"})
+
+	PointsCredited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "points_credited_total", Help: "Points credited to balances by source.",
+	}, []string{"source"})
+	PointsDebited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "points_debited_total", Help: "Points taken back from balances by adjustments, by source.",
+	}, []string{"source"})
+	PointsWithdrawn = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Name: "points_withdrawn_total", Help: "Points withdrawn from balances.",
+	})
+	LoginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "login_failures_total", Help: "Failed logins by reason.",
+	}, []string{"reason"})
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "rate_limited_total", Help: "Requests rejected with 429 by route group.",
+	}, []string{"group"})
+)
+
+// Sources of credited and debited points.
+const (
+	SourceAccrual        = "accrual"
+	SourcePromo          = "promo"
+	SourceReconciliation = "reconciliation"
+	SourceAdjustment     = "adjustment"
+)
+
+var queueDepth = func() int { return 0 }
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests, HTTPDuration,
+		AccrualInFlight, AccrualDropped, AccrualRateLimited, AccrualRetryAfter, AccrualBreakerState,
+		PointsCredited, PointsDebited, PointsWithdrawn, LoginFailures, RateLimited,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "accrual_queue_depth", Help: "Orders waiting in the accrual queue.",
+		}, func() float64 { return float64(queueDepth()) }),
+	)
+}
+
+// Credit counts points posted to a balance, negative ones are counted as debited.
+func Credit(source string, points float32) {
+	if points >= 0 {
+		PointsCredited.WithLabelValues(source).Add(float64(points))
+	} else {
+		PointsDebited.WithLabelValues(source).Add(float64(-points))
+	}
+}
+
+// WatchAccrualQueue sets the function that reports the accrual queue depth.
+func WatchAccrualQueue(depth func() int) {
+	queueDepth = depth
+}
+
+// WatchDB exports the connection pool stats of the database.
+func WatchDB(db *sql.DB) {
+	Registry.MustRegister(collectors.NewDBStatsCollector(db, namespace))
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Middleware counts requests by chi route pattern, so /api/user/orders/{number} is one
+// series however many orders there are.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(sw.status)).Inc()
+		HTTPDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func scrape(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("scrape status = %d", w.Code)
+	}
+	data, err := io.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestScrape(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(Middleware)
+	r.Get("/api/user/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	for _, number := range []string{"18", "26", "34"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/user/orders/"+number, nil))
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+
+	Credit(SourceAccrual, 100)
+	Credit(SourcePromo, 10)
+	Credit(SourceReconciliation, 5.5)
+	Credit(SourceReconciliation, -2)
+	Credit(SourceAdjustment, 7)
+	WatchAccrualQueue(func() int { return 3 })
+	defer WatchAccrualQueue(func() int { return 0 })
+
+	body := scrape(t)
+	for _, want := range []string{
+		`gophermart_http_requests_total{code="404",method="GET",route="/api/user/orders/{number}"} 3`,
+		`gophermart_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`gophermart_http_request_duration_seconds_count{method="GET",route="/api/user/orders/{number}"} 3`,
+		`gophermart_points_credited_total{source="accrual"} 100`,
+		`gophermart_points_credited_total{source="promo"} 10`,
+		`gophermart_points_credited_total{source="reconciliation"} 5.5`,
+		`gophermart_points_credited_total{source="adjustment"} 7`,
+		`gophermart_points_debited_total{source="reconciliation"} 2`,
+		`gophermart_accrual_queue_depth 3`,
+		`go_goroutines `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape has no %s", want)
+		}
+	}
+	// every order number is one series, not one per number
+	if strings.Contains(body, `route="/api/user/orders/18"`) {
+		t.Error("route label contains the order number")
+	}
+}
@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+)
+
+var DecompressLimit int64 = 1 << 20
+var CompressMinSize = 1024
+
+var compressibleTypes = map[string]bool{
+	"application/json":         true,
+	"application/problem+json": true,
+	"text/plain":               true,
+	"text/html":                true,
+}
+
+// corruptReader reports broken compressed data as body.ErrCorrupt, so the client gets 400
+// rather than an internal error.
+type corruptReader struct {
+	io.Reader
+}
+
+func (c corruptReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", body.ErrCorrupt, err)
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	var err error
+	for _, c := range rc.closers {
+		if errClose := c.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
+
+// Decompress unpacks gzip and deflate request bodies. The decompressed body is limited
+// by DecompressLimit, so a small compressed payload can't blow up into gigabytes.
+func Decompress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		var reader io.ReadCloser
+		switch encoding {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				apierror.Write(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "wrong gzip body"))
+				return
+			}
+			reader = &readCloser{Reader: corruptReader{gz}, closers: []io.Closer{gz, r.Body}}
+		case "deflate":
+			reader = newDeflateReader(r.Body)
+		default:
+			apierror.Write(w, r, apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType, "unsupported content encoding"))
+			return
+		}
+
+		r.Body = body.LimitReader(reader, DecompressLimit)
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newDeflateReader accepts both zlib-wrapped deflate (as RFC 9110 says) and the raw
+// deflate stream that some clients send instead.
+func newDeflateReader(body io.ReadCloser) io.ReadCloser {
+	buffered := bufio.NewReader(body)
+	header, _ := buffered.Peek(2)
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		if zr, err := zlib.NewReader(buffered); err == nil {
+			return &readCloser{Reader: corruptReader{zr}, closers: []io.Closer{zr, body}}
+		}
+	}
+	fr := flate.NewReader(buffered)
+	return &readCloser{Reader: corruptReader{fr}, closers: []io.Closer{fr, body}}
+}
+
+// Compress encodes responses with gzip or deflate according to Accept-Encoding. The body
+// is buffered until CompressMinSize bytes are written, smaller responses are sent as is.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+func acceptedEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// q=0 means the client refuses the encoding
+		if q <= 0 {
+			continue
+		}
+		// gzip wins ties
+		if q > bestQ || (q == bestQ && name == "gzip") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	writer      io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	cw.wroteHeader = true
+	if cw.decided {
+		if cw.writer != nil {
+			return cw.writer.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= CompressMinSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(len(cw.buf) >= CompressMinSize)
+	}
+	if fw, ok := cw.writer.(interface{ Flush() error }); ok {
+		fw.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if err := cw.decide(len(cw.buf) >= CompressMinSize); err != nil {
+			return err
+		}
+	}
+	if cw.writer != nil {
+		return cw.writer.Close()
+	}
+	return nil
+}
+
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if compress && compressibleTypes[mediaType] && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		header.Add("Vary", "Accept-Encoding")
+		if cw.encoding == "gzip" {
+			cw.writer = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.writer = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.writer != nil {
+		_, err = cw.writer.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/handlers"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"GZIP", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"gzip;q=0, deflate;q=0.1", "deflate"},
+		{"identity, gzip;q=0", ""},
+		{"br", ""},
+	}
+	for _, tt := range tests {
+		if got := acceptedEncoding(tt.header); got != tt.want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	defer func(size int) { CompressMinSize = size }(CompressMinSize)
+	CompressMinSize = 100
+	large := strings.Repeat(`{"order":"79927398713"}`, 10)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		wantEncoding   string
+	}{
+		{"large JSON", "gzip", "application/json", large, "gzip"},
+		{"large JSON deflate", "deflate", "application/json", large, "deflate"},
+		{"under CompressMinSize", "gzip", "application/json", `{"status":"NEW"}`, ""},
+		{"refused gzip", "gzip;q=0", "application/json", large, ""},
+		{"identity", "identity", "application/json", large, ""},
+		{"not compressible", "gzip", "image/png", large, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				// written in parts, so the buffering before the decision is exercised
+				_, _ = io.WriteString(w, tt.body[:len(tt.body)/2])
+				_, _ = io.WriteString(w, tt.body[len(tt.body)/2:])
+			}))
+			request := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			request.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+
+			if got := response.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			var reader io.Reader = response.Body
+			switch tt.wantEncoding {
+			case "gzip":
+				gz, err := gzip.NewReader(response.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reader = gz
+			case "deflate":
+				zr, err := zlib.NewReader(response.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reader = zr
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.body {
+				t.Errorf("body = %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func compressed(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	default:
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decompress passes the request body through Decompress and returns what the handler read.
+func decompress(contentEncoding string, data []byte) (*httptest.ResponseRecorder, []byte, error) {
+	var read []byte
+	var readErr error
+	handler := Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, readErr = io.ReadAll(r.Body)
+	}))
+	request := httptest.NewRequest(http.MethodPost, "/api/user/orders", bytes.NewReader(data))
+	request.Header.Set("Content-Encoding", contentEncoding)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response, read, readErr
+}
+
+func TestDecompress(t *testing.T) {
+	data := []byte(`{"order":"79927398713"}`)
+	tests := []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+	}{
+		{"gzip", "gzip", compressed(t, "gzip", data)},
+		{"x-gzip", "x-gzip", compressed(t, "gzip", data)},
+		{"zlib deflate", "deflate", compressed(t, "zlib", data)},
+		{"raw deflate", "deflate", compressed(t, "flate", data)},
+		{"identity", "identity", data},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got, err := decompress(tt.contentEncoding, tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("body = %q, want %q", got, data)
+			}
+		})
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	defer func(limit int64) { DecompressLimit = limit }(DecompressLimit)
+	DecompressLimit = 1 << 10
+	// a few kilobytes that unpack into a megabyte
+	bomb := compressed(t, "gzip", make([]byte, 1<<20))
+
+	_, got, err := decompress("gzip", bomb)
+	if !errors.Is(err, body.ErrTooLarge) {
+		t.Errorf("reading a decompression bomb: err = %v, want ErrTooLarge", err)
+	}
+	if int64(len(got)) > DecompressLimit {
+		t.Errorf("read %d bytes, more than DecompressLimit", len(got))
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"order":"79927398713"}`), 10)
+	corrupt := func(encoding string) []byte {
+		packed := compressed(t, encoding, data)
+		// the header stays valid, the stream and the checksum don't
+		for i := 12; i < len(packed); i++ {
+			packed[i] ^= 0xff
+		}
+		return packed
+	}
+	for _, tt := range []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+	}{
+		{"gzip", "gzip", corrupt("gzip")},
+		{"truncated gzip", "gzip", compressed(t, "gzip", data)[:20]},
+		{"zlib deflate", "deflate", corrupt("zlib")},
+		{"raw deflate", "deflate", []byte{0xff, 0xff, 0xff, 0xff}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decompress(tt.contentEncoding, tt.body)
+			if !errors.Is(err, body.ErrCorrupt) {
+				t.Fatalf("err = %v, want ErrCorrupt", err)
+			}
+			if status := handlers.ToAPIError(err).Status; status != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", status)
+			}
+		})
+	}
+}
+
+func TestDecompressRejects(t *testing.T) {
+	for _, tt := range []struct {
+		contentEncoding string
+		status          int
+	}{
+		{"gzip", http.StatusBadRequest},
+		{"br", http.StatusUnsupportedMediaType},
+	} {
+		response, _, _ := decompress(tt.contentEncoding, []byte("not compressed"))
+		if response.Code != tt.status {
+			t.Errorf("Content-Encoding %s: status = %d, want %d", tt.contentEncoding, response.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDMaxLength bounds request IDs taken from clients, they end up in every log line.
+const requestIDMaxLength = 128
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	requestLoggerKey
+)
+
+// RequestID takes the request ID from X-Request-ID or generates one, returns it in the
+// response and puts a logger with it into the request context. Everything logged through
+// log.Ctx during the request carries the request ID and the trace ID.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		logContext := log.With().Str("request_id", id)
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.HasTraceID() {
+			logContext = logContext.Str("trace_id", spanContext.TraceID().String())
+		}
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = logContext.Logger().WithContext(ctx)
+		// WithContext stores a copy, later fields must go to that copy to reach log.Ctx
+		ctx = context.WithValue(ctx, requestLoggerKey, zerolog.Ctx(ctx))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetRequestID returns the ID of the request ctx belongs to, or "".
+func GetRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// setLogUser adds the user ID to the request logger, the access log line included.
+func setLogUser(ctx context.Context, userID int64) {
+	if logger, ok := ctx.Value(requestLoggerKey).(*zerolog.Logger); ok {
+		logger.UpdateContext(func(c zerolog.Context) zerolog.Context {
+			return c.Int64("user_id", userID)
+		})
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > requestIDMaxLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// AccessLog writes one line per request when it is done.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+
+		route := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		log.Ctx(r.Context()).Info().
+			Str("method", r.Method).
+			Str("route", route).
+			Str("path", r.URL.Path).
+			Int("status", aw.status).
+			Dur("latency", time.Since(start)).
+			Int64("bytes", aw.bytes).
+			Str("remote_addr", r.RemoteAddr).
+			Msg("request")
+	})
+}
+
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestAccessLogHasRequestAndUser(t *testing.T) {
+	var buf bytes.Buffer
+	global := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = global }()
+
+	handler := RequestID(AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setLogUser(r.Context(), 42)
+		log.Ctx(r.Context()).Info().Msg("handler")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("ok"))
+	})))
+	request := httptest.NewRequest(http.MethodPost, "/api/user/orders", nil)
+	request.Header.Set(RequestIDHeader, "req-1")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	if got := response.Header().Get(RequestIDHeader); got != "req-1" {
+		t.Errorf("response request ID = %q, want req-1", got)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2: %s", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["request_id"] != "req-1" || entry["user_id"] != float64(42) {
+			t.Errorf("log line %s misses request_id or user_id", line)
+		}
+	}
+	var access map[string]interface{}
+	_ = json.Unmarshal([]byte(lines[1]), &access)
+	if access["status"] != float64(http.StatusAccepted) || access["bytes"] != float64(2) || access["path"] != "/api/user/orders" {
+		t.Errorf("wrong access log line %s", lines[1])
+	}
+}
+
+func TestRequestIDIsGeneratedForBadHeaders(t *testing.T) {
+	for _, header := range []string{"", "with space", strings.Repeat("a", requestIDMaxLength+1)} {
+		var got string
+		handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = GetRequestID(r.Context())
+		}))
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set(RequestIDHeader, header)
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+		if got == "" || got == header {
+			t.Errorf("request ID for header %q = %q, want a generated one", header, got)
+		}
+	}
+}
@@ -1,34 +1,111 @@
 package middleware
 
 import (
-	"context"
+	"errors"
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
 	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+	"github.com/fortuna91/ya_praktikum_final/internal/db"
 	"github.com/fortuna91/ya_praktikum_final/internal/handlers"
+	"github.com/rs/zerolog/log"
+	"mime"
 	"net/http"
+	"strings"
 )
 
+// publicPaths are served without a token.
+var publicPaths = map[string]bool{
+	"/api/user/register": true,
+	"/api/user/login":    true,
+	"/metrics":           true,
+	"/healthz":           true,
+	"/readyz":            true,
+}
+
 func Authorization(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/api/user/register" || r.URL.Path == "/api/user/login" {
+		// internal endpoints are called by other services and check their own credentials
+		if publicPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/internal/") {
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		token, err := auth.GetTokenFromHeader(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, err.Error()))
 			return
 		}
 
 		login, errParse := auth.ParseToken(token)
 		if errParse != nil {
-			http.Error(w, errParse.Error(), http.StatusUnauthorized)
+			apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid access token"))
+			return
+		}
+		user := handlers.GetDB().GetUser(r.Context(), login)
+		if user == nil {
+			apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "unknown user"))
 			return
 		}
-		if user := handlers.GetDB().GetUser(context.Background(), login); user == nil {
-			http.Error(w, "unknown user", http.StatusUnauthorized)
+		setLogUser(r.Context(), user.ID)
+
+		if key := r.Header.Get(handlers.PartnerKeyHeader); key != "" {
+			partner, errPartner := handlers.AuthenticatePartner(r.Context(), key)
+			if errors.Is(errPartner, db.ErrPartnerNotFound) {
+				apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid partner key"))
+				return
+			}
+			if errPartner != nil {
+				log.Ctx(r.Context()).Error().Msgf("Couldn't check partner key: %v", errPartner)
+				apierror.Write(w, r, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, ""))
+				return
+			}
+			r = r.WithContext(handlers.WithPartner(r.Context(), partner))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func Admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := auth.GetTokenFromHeader(r)
+		login, _ := auth.ParseToken(token)
+		if user := handlers.GetDB().GetUser(r.Context(), login); user == nil || !user.IsAdmin {
+			apierror.Write(w, r, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "admin access required"))
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// LimitBody rejects request bodies larger than limit bytes with 413.
+func LimitBody(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				apierror.Write(w, r, apierror.New(http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, body.ErrTooLarge.Error()))
+				return
+			}
+			r.Body = body.LimitReader(r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireContentType rejects requests whose media type is not one of types with 415.
+func RequireContentType(types ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err == nil {
+				for _, t := range types {
+					if mediaType == t {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			apierror.Write(w, r, apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType,
+				"content type must be "+strings.Join(types, " or ")))
+		})
+	}
+}
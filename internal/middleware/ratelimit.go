@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/metrics"
+	"github.com/fortuna91/ya_praktikum_final/internal/ratelimit"
+)
+
+// RateLimit limits requests of the route group per user, or per client IP for requests
+// without a valid token. Requests over the limit get 429 with Retry-After, the same
+// contract the accrual system has with us. When the limiter fails, requests are let through.
+func RateLimit(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit, ok := ratelimit.LimitFor(group)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			retryAfter, err := ratelimit.Default.Allow(r.Context(), group+":"+rateLimitKey(r), limit)
+			if err != nil {
+				log.Ctx(r.Context()).Error().Msgf("Couldn't check rate limit: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if retryAfter > 0 {
+				metrics.RateLimited.WithLabelValues(group).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				apierror.Write(w, r, apierror.New(http.StatusTooManyRequests, apierror.CodeTooManyRequests,
+					"no more than "+strconv.Itoa(limit.Requests)+" requests per "+limit.Per.String()+" allowed"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func rateLimitKey(r *http.Request) string {
+	if token, err := auth.GetTokenFromHeader(r); err == nil {
+		if login, err := auth.ParseToken(token); err == nil {
+			return "user:" + login
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
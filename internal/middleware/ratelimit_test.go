@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/ratelimit"
+)
+
+// fixedLimiter answers every request with wait and err and records the keys.
+type fixedLimiter struct {
+	wait time.Duration
+	err  error
+	keys []string
+}
+
+func (l *fixedLimiter) Allow(_ context.Context, key string, _ ratelimit.Limit) (time.Duration, error) {
+	l.keys = append(l.keys, key)
+	return l.wait, l.err
+}
+
+func serveRateLimited(t *testing.T, limiter ratelimit.Limiter, group string) *httptest.ResponseRecorder {
+	t.Helper()
+	handler := RateLimit(group)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	global := ratelimit.Default
+	ratelimit.Default = limiter
+	defer func() { ratelimit.Default = global }()
+
+	request := httptest.NewRequest(http.MethodPost, "/api/user/orders", nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+func TestRateLimit(t *testing.T) {
+	ratelimit.SetLimits(map[string]ratelimit.Limit{ratelimit.GroupOrders: {Requests: 60, Per: time.Minute}})
+	defer ratelimit.SetLimits(nil)
+
+	tests := []struct {
+		name       string
+		wait       time.Duration
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{"within the limit", 0, nil, http.StatusOK, ""},
+		{"over the limit", 30 * time.Second, nil, http.StatusTooManyRequests, "30"},
+		{"partial seconds round up", 1200 * time.Millisecond, nil, http.StatusTooManyRequests, "2"},
+		{"sub-second wait rounds up to 1", 300 * time.Millisecond, nil, http.StatusTooManyRequests, "1"},
+		{"tiny wait rounds up to 1", time.Nanosecond, nil, http.StatusTooManyRequests, "1"},
+		{"failing limiter lets requests through", 0, errors.New("database is down"), http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &fixedLimiter{wait: tt.wait, err: tt.err}
+			response := serveRateLimited(t, limiter, ratelimit.GroupOrders)
+			if response.Code != tt.status {
+				t.Fatalf("status = %d, want %d", response.Code, tt.status)
+			}
+			if got := response.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+			if len(limiter.keys) != 1 || limiter.keys[0] != ratelimit.GroupOrders+":ip:192.0.2.1" {
+				t.Errorf("limiter keys = %q, want the group and the client IP", limiter.keys)
+			}
+			if tt.status != http.StatusTooManyRequests {
+				return
+			}
+			var problem apierror.Error
+			if err := json.Unmarshal(response.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("response %q: %v", response.Body.String(), err)
+			}
+			if problem.Code != apierror.CodeTooManyRequests {
+				t.Errorf("problem code = %q, want %q", problem.Code, apierror.CodeTooManyRequests)
+			}
+		})
+	}
+}
+
+func TestRateLimitGroupWithoutLimit(t *testing.T) {
+	ratelimit.SetLimits(map[string]ratelimit.Limit{ratelimit.GroupOrders: {Requests: 1, Per: time.Minute}})
+	defer ratelimit.SetLimits(nil)
+
+	limiter := &fixedLimiter{wait: time.Minute}
+	if response := serveRateLimited(t, limiter, ratelimit.GroupBalance); response.Code != http.StatusOK {
+		t.Errorf("status = %d for a group without a limit, want 200", response.Code)
+	}
+	if len(limiter.keys) != 0 {
+		t.Errorf("limiter was asked about %q", limiter.keys)
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/apierror"
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/body"
+)
+
+const (
+	SignatureHeader = "X-Signature"
+	TimestampHeader = "X-Signature-Timestamp"
+)
+
+// SignatureMaxAge is how old a signed request may be, which limits replaying it.
+var SignatureMaxAge = 5 * time.Minute
+
+// Signature rejects requests without a valid X-Signature header. The sender signs
+// "<timestamp>.<body>" with HMAC-SHA256 and the shared secret, the same way the
+// outgoing webhooks are signed, and sends "sha256=<hex>" along with the Unix timestamp.
+func Signature(secret string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timestamp := r.Header.Get(TimestampHeader)
+			seconds, err := strconv.ParseInt(timestamp, 10, 64)
+			age := time.Since(time.Unix(seconds, 0))
+			if err != nil || age > SignatureMaxAge || age < -SignatureMaxAge {
+				apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid signature timestamp"))
+				return
+			}
+			data, err := body.ReadAll(r.Body)
+			if errors.Is(err, body.ErrTooLarge) {
+				apierror.Write(w, r, apierror.New(http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, err.Error()))
+				return
+			}
+			if err != nil {
+				apierror.Write(w, r, apierror.New(http.StatusBadRequest, apierror.CodeBadRequest, "couldn't read request body"))
+				return
+			}
+			expected := "sha256=" + auth.CalcHash(secret, timestamp+"."+string(data))
+			if !hmac.Equal([]byte(expected), []byte(r.Header.Get(SignatureHeader))) {
+				apierror.Write(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid signature"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(data))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
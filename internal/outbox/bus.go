@@ -0,0 +1,43 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+// Handler consumes messages of the in-process bus. An error makes the relay retry the
+// message later.
+type Handler func(ctx context.Context, message entity.OutboxMessage) error
+
+// Bus passes messages to handlers subscribed to their type, or to all types.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+var DefaultBus = NewBus()
+
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[string][]Handler)}
+}
+
+// Subscribe registers the handler for the message type, an empty type means all messages.
+func (b *Bus) Subscribe(messageType string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[messageType] = append(b.handlers[messageType], handler)
+}
+
+func (b *Bus) Publish(ctx context.Context, message entity.OutboxMessage) error {
+	b.mu.RLock()
+	handlers := append(append([]Handler{}, b.handlers[""]...), b.handlers[message.Type]...)
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		if err := handler(ctx, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+// FilePublisher appends messages to a file or a writer as JSON lines.
+type FilePublisher struct {
+	mu     sync.Mutex
+	writer io.Writer
+	file   *os.File
+}
+
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FilePublisher{writer: file, file: file}, nil
+}
+
+func NewWriterPublisher(writer io.Writer) *FilePublisher {
+	return &FilePublisher{writer: writer}
+}
+
+func (p *FilePublisher) Publish(_ context.Context, message entity.OutboxMessage) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err = p.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if p.file != nil {
+		return p.file.Sync()
+	}
+	return nil
+}
+
+func (p *FilePublisher) Close() error {
+	if p.file != nil {
+		return p.file.Close()
+	}
+	return nil
+}
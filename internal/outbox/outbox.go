@@ -0,0 +1,93 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+var PollInterval = time.Second
+var BatchSize = 100
+
+// Publisher sends an outbox message to the outside world. Messages of a user are passed in
+// the order they were written; a message can be passed again after a failure or a restart,
+// so consumers must deduplicate by message ID.
+type Publisher interface {
+	Publish(ctx context.Context, message entity.OutboxMessage) error
+}
+
+// Run publishes the outbox until ctx is done.
+func Run(ctx context.Context, db *dbmodule.DBStorage, publisher Publisher) {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := db.RelayOutbox(ctx, BatchSize, func(messages []entity.OutboxMessage) []int64 {
+			return publish(ctx, publisher, messages)
+		})
+		if err != nil {
+			log.Error().Msgf("Couldn't relay outbox: %v", err)
+		}
+	}
+}
+
+// publish returns the IDs of the published messages. After a failure the later messages of
+// the same user are held back until the next run, so they are never published out of order.
+func publish(ctx context.Context, publisher Publisher, messages []entity.OutboxMessage) []int64 {
+	var published []int64
+	blocked := make(map[int64]bool)
+	for _, message := range messages {
+		if blocked[message.UserID] {
+			continue
+		}
+		if err := publisher.Publish(ctx, message); err != nil {
+			log.Warn().Msgf("Couldn't publish outbox message %d: %v", message.ID, err)
+			blocked[message.UserID] = true
+			continue
+		}
+		published = append(published, message.ID)
+	}
+	return published
+}
+
+// Multi passes every message to all publishers and fails if any of them fails.
+type Multi []Publisher
+
+func (m Multi) Publish(ctx context.Context, message entity.OutboxMessage) error {
+	for _, publisher := range m {
+		if err := publisher.Publish(ctx, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay publishes the messages after fromID again, whether they were published or not,
+// and returns their count. userID 0 replays messages of all users.
+func Replay(ctx context.Context, db *dbmodule.DBStorage, publisher Publisher, fromID int64, userID int64) (int, error) {
+	count := 0
+	for {
+		messages, err := db.GetOutbox(ctx, fromID, userID, BatchSize)
+		if err != nil {
+			return count, err
+		}
+		for _, message := range messages {
+			if err = publisher.Publish(ctx, message); err != nil {
+				return count, err
+			}
+			fromID = message.ID
+			count++
+		}
+		if len(messages) < BatchSize {
+			return count, nil
+		}
+	}
+}
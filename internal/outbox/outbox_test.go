@@ -0,0 +1,178 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+// recorder records published messages and fails those listed in fail.
+type recorder struct {
+	fail      map[int64]bool
+	published []int64
+}
+
+func (r *recorder) Publish(_ context.Context, message entity.OutboxMessage) error {
+	if r.fail[message.ID] {
+		return errors.New("publish failed")
+	}
+	r.published = append(r.published, message.ID)
+	return nil
+}
+
+func TestPublishKeepsUserOrder(t *testing.T) {
+	messages := []entity.OutboxMessage{
+		{ID: 1, UserID: 1}, {ID: 2, UserID: 2}, {ID: 3, UserID: 1}, {ID: 4, UserID: 2}, {ID: 5, UserID: 3},
+	}
+	tests := []struct {
+		name      string
+		fail      []int64
+		published []int64
+	}{
+		{"all published", nil, []int64{1, 2, 3, 4, 5}},
+		{"failure holds back later messages of the user", []int64{1}, []int64{2, 4, 5}},
+		{"failure of the last message", []int64{4}, []int64{1, 2, 3, 5}},
+		{"failures of two users", []int64{2, 3}, []int64{1, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &recorder{fail: map[int64]bool{}}
+			for _, id := range tt.fail {
+				publisher.fail[id] = true
+			}
+			got := publish(context.Background(), publisher, messages)
+			if !reflect.DeepEqual(got, tt.published) {
+				t.Errorf("published %v, want %v", got, tt.published)
+			}
+			if !reflect.DeepEqual(publisher.published, tt.published) {
+				t.Errorf("publisher got %v, want %v", publisher.published, tt.published)
+			}
+		})
+	}
+}
+
+func TestMulti(t *testing.T) {
+	first, second := &recorder{}, &recorder{fail: map[int64]bool{2: true}}
+	multi := Multi{first, second}
+	if err := multi.Publish(context.Background(), entity.OutboxMessage{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := multi.Publish(context.Background(), entity.OutboxMessage{ID: 2}); err == nil {
+		t.Error("Multi ignored a failed publisher")
+	}
+	if !reflect.DeepEqual(second.published, []int64{1}) {
+		t.Errorf("second publisher got %v, want [1]", second.published)
+	}
+}
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	var got []string
+	subscribe := func(name string, messageType string) {
+		bus.Subscribe(messageType, func(_ context.Context, message entity.OutboxMessage) error {
+			got = append(got, name+":"+message.Type)
+			return nil
+		})
+	}
+	subscribe("all", "")
+	subscribe("orders", entity.OutboxOrderAdded)
+	subscribe("withdrawals", entity.OutboxWithdrawalMade)
+
+	ctx := context.Background()
+	if err := bus.Publish(ctx, entity.OutboxMessage{Type: entity.OutboxOrderAdded}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(ctx, entity.OutboxMessage{Type: entity.OutboxBalanceCredited}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"all:" + entity.OutboxOrderAdded, "orders:" + entity.OutboxOrderAdded, "all:" + entity.OutboxBalanceCredited}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("handlers got %v, want %v", got, want)
+	}
+}
+
+func TestBusHandlerError(t *testing.T) {
+	bus := NewBus()
+	failure := errors.New("handler failed")
+	called := false
+	bus.Subscribe("", func(context.Context, entity.OutboxMessage) error { return failure })
+	bus.Subscribe("", func(context.Context, entity.OutboxMessage) error {
+		called = true
+		return nil
+	})
+	if err := bus.Publish(context.Background(), entity.OutboxMessage{}); !errors.Is(err, failure) {
+		t.Errorf("Publish returned %v, want the handler error", err)
+	}
+	if called {
+		t.Error("handlers after the failed one were called")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		dsn = os.Getenv("DATABASE_URI")
+	}
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI or DATABASE_URI is not set")
+	}
+	db, err := dbmodule.New(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	db.Create(ctx)
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	login := "replay-" + suffix
+	if err = db.AddUser(ctx, login, "hash"); err != nil {
+		t.Fatal(err)
+	}
+	user := db.GetUser(ctx, login)
+	if user == nil {
+		t.Fatalf("user %s wasn't added", login)
+	}
+	for i := 0; i < 5; i++ {
+		if err = db.AddOrder(ctx, suffix+strconv.Itoa(i), user.ID, "NEW", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(size int) { BatchSize = size }(BatchSize)
+	// pages smaller than the messages of the user
+	BatchSize = 2
+	publisher := &recorder{}
+	count, err := Replay(ctx, db, publisher, 0, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 || len(publisher.published) != 5 {
+		t.Fatalf("replayed %d messages, published %v, want 5", count, publisher.published)
+	}
+	for i := 1; i < len(publisher.published); i++ {
+		if publisher.published[i] <= publisher.published[i-1] {
+			t.Errorf("messages replayed out of order: %v", publisher.published)
+		}
+	}
+
+	from := publisher.published[1]
+	publisher = &recorder{fail: map[int64]bool{}}
+	count, err = Replay(ctx, db, publisher, from, user.ID)
+	if err != nil || count != 3 {
+		t.Errorf("replay from %d: %d messages, %v, want 3", from, count, err)
+	}
+
+	publisher = &recorder{fail: map[int64]bool{publisher.published[1]: true}}
+	count, err = Replay(ctx, db, publisher, from, user.ID)
+	if err == nil || count != 1 {
+		t.Errorf("replay with a failing publisher: %d messages, %v, want 1 and an error", count, err)
+	}
+}
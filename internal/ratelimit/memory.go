@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often counters of finished windows are dropped.
+const sweepInterval = time.Minute
+
+type window struct {
+	start time.Time
+	end   time.Time
+	count int
+}
+
+// Memory counts requests in fixed windows in this process only. With several instances
+// every instance allows the full limit.
+type Memory struct {
+	mu        sync.Mutex
+	windows   map[string]*window
+	lastSweep time.Time
+	// now is replaced by a fake clock in tests
+	now func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{windows: map[string]*window{}, lastSweep: time.Now(), now: time.Now}
+}
+
+func (m *Memory) Allow(_ context.Context, key string, limit Limit) (time.Duration, error) {
+	now := m.now()
+	start := now.Truncate(limit.Per)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastSweep) > sweepInterval {
+		m.sweep(now)
+	}
+	w, ok := m.windows[key]
+	if !ok || !w.start.Equal(start) {
+		w = &window{start: start, end: start.Add(limit.Per)}
+		m.windows[key] = w
+	}
+	w.count++
+	if w.count > limit.Requests {
+		return w.end.Sub(now), nil
+	}
+	return 0, nil
+}
+
+func (m *Memory) sweep(now time.Time) {
+	for key, w := range m.windows {
+		if !now.Before(w.end) {
+			delete(m.windows, key)
+		}
+	}
+	m.lastSweep = now
+}
@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+)
+
+// staleAfter is how long counters of keys that are not seen anymore are kept.
+const staleAfter = time.Hour
+
+// Postgres shares the counters between instances through the database. Every request
+// costs one upsert.
+type Postgres struct {
+	db *dbmodule.DBStorage
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewPostgres(db *dbmodule.DBStorage) *Postgres {
+	return &Postgres{db: db, lastSweep: time.Now()}
+}
+
+func (p *Postgres) Allow(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	p.sweep()
+	count, left, err := p.db.HitRateLimit(ctx, key, limit.Per)
+	if err != nil {
+		return 0, err
+	}
+	if count > limit.Requests {
+		return left, nil
+	}
+	return 0, nil
+}
+
+// sweep removes stale counters in the background once per sweepInterval.
+func (p *Postgres) sweep() {
+	p.mu.Lock()
+	if time.Since(p.lastSweep) < sweepInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.lastSweep = time.Now()
+	p.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sweepInterval)
+		defer cancel()
+		if err := p.db.DeleteStaleRateLimits(ctx, staleAfter); err != nil {
+			log.Error().Msgf("Couldn't delete stale rate limits: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route groups of the API, each with its own limit.
+const (
+	// GroupAuth is registration and login, limited per client IP.
+	GroupAuth = "auth"
+	// GroupOrders is order uploads.
+	GroupOrders = "orders"
+	// GroupBalance is the balance, withdrawals and promo codes.
+	GroupBalance = "balance"
+	// GroupDefault is the rest of the user API.
+	GroupDefault = "default"
+)
+
+// Limit allows Requests requests per fixed window of length Per.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l Limit) String() string {
+	return strconv.Itoa(l.Requests) + "/" + l.Per.String()
+}
+
+// Limiter counts requests of a key. Allow returns a positive duration when the request
+// is over the limit: the time until the next window.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (time.Duration, error)
+}
+
+// Default is the limiter of the API, in memory unless main sets a shared one.
+var Default Limiter = NewMemory()
+
+var mu sync.RWMutex
+var limits = map[string]Limit{}
+
+// SetLimits replaces the limits of all route groups at once. Groups without a limit are
+// not limited.
+func SetLimits(groupLimits map[string]Limit) {
+	copied := make(map[string]Limit, len(groupLimits))
+	for group, limit := range groupLimits {
+		copied[group] = limit
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	limits = copied
+}
+
+func LimitFor(group string) (Limit, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	limit, ok := limits[group]
+	return limit, ok
+}
+
+// ParseLimits parses a comma-separated list of group=requests/period, e.g.
+// "auth=10/m,orders=60/1m". A period without a number means one unit of it.
+func ParseLimits(spec string) (map[string]Limit, error) {
+	groupLimits := map[string]Limit{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		group, value, ok := strings.Cut(item, "=")
+		if !ok || group == "" {
+			return nil, fmt.Errorf("rate limit %q: want group=requests/period", item)
+		}
+		requests, period, ok := strings.Cut(value, "/")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q: want group=requests/period", item)
+		}
+		n, err := strconv.Atoi(requests)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("rate limit %q: requests must be a positive number", item)
+		}
+		if period != "" && (period[0] < '0' || period[0] > '9') {
+			period = "1" + period
+		}
+		per, err := time.ParseDuration(period)
+		if err != nil || per < time.Second {
+			return nil, fmt.Errorf("rate limit %q: period must be a duration of at least 1s", item)
+		}
+		groupLimits[group] = Limit{Requests: n, Per: per}
+	}
+	return groupLimits, nil
+}
+
+// FormatLimits is the reverse of ParseLimits, with groups sorted.
+func FormatLimits(groupLimits map[string]Limit) string {
+	groups := make([]string, 0, len(groupLimits))
+	for group := range groupLimits {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	items := make([]string, 0, len(groups))
+	for _, group := range groups {
+		items = append(items, group+"="+groupLimits[group].String())
+	}
+	return strings.Join(items, ",")
+}
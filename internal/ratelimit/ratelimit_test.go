@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+)
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]Limit
+	}{
+		{"", map[string]Limit{}},
+		{"auth=10/1m", map[string]Limit{GroupAuth: {10, time.Minute}}},
+		{" auth=10/m , orders=60/1h,", map[string]Limit{GroupAuth: {10, time.Minute}, GroupOrders: {60, time.Hour}}},
+		{"default=5/30s", map[string]Limit{GroupDefault: {5, 30 * time.Second}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimits(tt.spec)
+		if err != nil {
+			t.Errorf("ParseLimits(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLimits(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"auth", "=10/m", "auth=10", "auth=ten/m", "auth=0/m", "auth=-1/m",
+		"auth=10/500ms", "auth=10/fortnight"} {
+		if _, err := ParseLimits(spec); err == nil {
+			t.Errorf("ParseLimits(%q) accepted it", spec)
+		}
+	}
+}
+
+func TestFormatLimits(t *testing.T) {
+	spec := "orders=60/1m,auth=10/30s"
+	limits, err := ParseLimits(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatted := FormatLimits(limits)
+	if formatted != "auth=10/30s,orders=60/1m0s" {
+		t.Errorf("FormatLimits() = %q", formatted)
+	}
+	if again, _ := ParseLimits(formatted); !reflect.DeepEqual(again, limits) {
+		t.Errorf("ParseLimits(FormatLimits()) = %v, want %v", again, limits)
+	}
+}
+
+func newTestMemory(now time.Time) (*Memory, *time.Time) {
+	m := NewMemory()
+	m.lastSweep = now
+	m.now = func() time.Time { return now }
+	return m, &now
+}
+
+func TestMemoryAllow(t *testing.T) {
+	ctx := context.Background()
+	limit := Limit{Requests: 2, Per: time.Minute}
+	m, now := newTestMemory(time.Date(2022, 1, 1, 12, 0, 10, 0, time.UTC))
+
+	for i := 0; i < limit.Requests; i++ {
+		if wait, _ := m.Allow(ctx, "a", limit); wait != 0 {
+			t.Fatalf("request %d waits %v within the limit", i+1, wait)
+		}
+	}
+	if wait, _ := m.Allow(ctx, "a", limit); wait != 50*time.Second {
+		t.Errorf("request over the limit waits %v, want 50s until the next window", wait)
+	}
+	if wait, _ := m.Allow(ctx, "b", limit); wait != 0 {
+		t.Errorf("another key waits %v", wait)
+	}
+
+	// the window rolls over at the minute, not a minute after the first request
+	*now = now.Add(50 * time.Second)
+	if wait, _ := m.Allow(ctx, "a", limit); wait != 0 {
+		t.Errorf("first request of the next window waits %v", wait)
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	ctx := context.Background()
+	limit := Limit{Requests: 1, Per: time.Second}
+	m, now := newTestMemory(time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC))
+	_, _ = m.Allow(ctx, "old", limit)
+
+	*now = now.Add(sweepInterval / 2)
+	_, _ = m.Allow(ctx, "recent", limit)
+	if len(m.windows) != 2 {
+		t.Fatalf("%d windows before the sweep, want 2", len(m.windows))
+	}
+
+	*now = now.Add(sweepInterval/2 + time.Millisecond)
+	_, _ = m.Allow(ctx, "new", limit)
+	if _, ok := m.windows["old"]; ok {
+		t.Error("finished window wasn't swept")
+	}
+	if _, ok := m.windows["new"]; !ok || len(m.windows) != 1 {
+		t.Errorf("windows after the sweep: %v, want only the new one", m.windows)
+	}
+}
+
+func TestPostgresAllow(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		dsn = os.Getenv("DATABASE_URI")
+	}
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI or DATABASE_URI is not set")
+	}
+	db, err := dbmodule.New(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	db.Create(ctx)
+
+	// two instances share the counters
+	first, second := NewPostgres(db), NewPostgres(db)
+	key := "test:" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	limit := Limit{Requests: 3, Per: 24 * time.Hour}
+	for i, limiter := range []*Postgres{first, second, first} {
+		wait, err := limiter.Allow(ctx, key, limit)
+		if err != nil || wait != 0 {
+			t.Fatalf("request %d: Allow() = %v, %v, want it allowed", i+1, wait, err)
+		}
+	}
+	wait, err := second.Allow(ctx, key, limit)
+	if err != nil || wait <= 0 || wait > limit.Per {
+		t.Fatalf("request over the limit: Allow() = %v, %v, want a wait until the next window", wait, err)
+	}
+
+	// a counter deleted by the sweep starts over
+	if err = db.DeleteStaleRateLimits(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err = first.Allow(ctx, key, limit); err != nil || wait != 0 {
+		t.Errorf("request after the sweep: Allow() = %v, %v, want it allowed", wait, err)
+	}
+}
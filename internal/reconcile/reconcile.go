@@ -0,0 +1,133 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/accrual"
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+var Interval = time.Hour
+var Window = 72 * time.Hour
+var BatchSize = 100
+
+// Correct makes scheduled runs post adjustments for the discrepancies they find.
+var Correct = false
+
+// DryRun makes scheduled runs only report discrepancies without writing anything.
+var DryRun = false
+
+// tolerance ignores float rounding of the stored amounts.
+const tolerance = 0.005
+
+type Options struct {
+	DryRun  bool `json:"dry_run"`
+	Correct bool `json:"correct"`
+}
+
+type Report struct {
+	Options
+	StartedAt     time.Time                   `json:"started_at"`
+	FinishedAt    time.Time                   `json:"finished_at"`
+	Checked       int                         `json:"checked"`
+	Discrepancies []entity.AccrualDiscrepancy `json:"discrepancies"`
+	Adjustments   []entity.BalanceAdjustment  `json:"adjustments,omitempty"`
+	// Incomplete is set when the run has stopped early, the reason is in Error.
+	Incomplete bool   `json:"incomplete"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Run reconciles recently processed orders every Interval until ctx is done.
+func Run(ctx context.Context, db *dbmodule.DBStorage) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report := Check(ctx, db, Options{DryRun: DryRun, Correct: Correct})
+		log.Info().Msgf("Accrual reconciliation: %d orders checked, %d discrepancies, %d adjustments, incomplete: %v %s",
+			report.Checked, len(report.Discrepancies), len(report.Adjustments), report.Incomplete, report.Error)
+	}
+}
+
+// Check asks the accrual system again about the orders processed within Window and
+// compares the amounts with the stored ones. Discrepancies are recorded and, with
+// Correct, adjusted; a dry run only reports them.
+func Check(ctx context.Context, db *dbmodule.DBStorage, options Options) *Report {
+	report := &Report{Options: options, StartedAt: time.Now(), Discrepancies: []entity.AccrualDiscrepancy{}}
+	since := report.StartedAt.Add(-Window)
+	afterID := ""
+	for {
+		orders, err := db.GetProcessedOrdersSince(ctx, since, afterID, BatchSize)
+		if err != nil {
+			report.stop(err)
+			return report
+		}
+		for _, order := range orders {
+			if err = check(ctx, db, report, order); err != nil {
+				report.stop(err)
+				return report
+			}
+			afterID = order.ID
+		}
+		if len(orders) < BatchSize {
+			report.FinishedAt = time.Now()
+			return report
+		}
+	}
+}
+
+func check(ctx context.Context, db *dbmodule.DBStorage, report *Report, order entity.Order) error {
+	actual, wait, err := accrual.Fetch(ctx, order)
+	if wait > 0 {
+		return fmt.Errorf("accrual system is unavailable, retry in %s", wait)
+	}
+	if errors.Is(err, accrual.ErrNotRegistered) {
+		actual = &entity.Order{Status: "NOT_REGISTERED"}
+	} else if err != nil {
+		return err
+	}
+	report.Checked++
+	if actual.Status == order.Status && math.Abs(float64(actual.Accrual-order.Accrual)) < tolerance {
+		return nil
+	}
+
+	discrepancy := entity.AccrualDiscrepancy{OrderID: order.ID, UserID: order.UserID, Status: order.Status,
+		Accrual: order.Accrual, ActualStatus: actual.Status, ActualAccrual: actual.Accrual}
+	if report.DryRun {
+		report.Discrepancies = append(report.Discrepancies, discrepancy)
+		return nil
+	}
+	if err = db.AddDiscrepancy(ctx, &discrepancy); err != nil {
+		return err
+	}
+	// only final results are corrected, an order the accrual system is still working on
+	// or doesn't know is left for a person to look at
+	if report.Correct && dbmodule.IsFinalStatus(actual.Status) {
+		adjustment, errAdjust := db.CorrectDiscrepancy(ctx, &discrepancy)
+		if errAdjust != nil && !errors.Is(errAdjust, dbmodule.ErrOrderChanged) {
+			return errAdjust
+		}
+		if adjustment != nil {
+			report.Adjustments = append(report.Adjustments, *adjustment)
+		}
+	}
+	report.Discrepancies = append(report.Discrepancies, discrepancy)
+	return nil
+}
+
+func (r *Report) stop(err error) {
+	r.Incomplete = true
+	r.Error = err.Error()
+	r.FinishedAt = time.Now()
+}
@@ -2,22 +2,83 @@ package server
 
 import (
 	"github.com/fortuna91/ya_praktikum_final/internal/handlers"
+	"github.com/fortuna91/ya_praktikum_final/internal/health"
+	"github.com/fortuna91/ya_praktikum_final/internal/metrics"
+	"github.com/fortuna91/ya_praktikum_final/internal/middleware"
+	"github.com/fortuna91/ya_praktikum_final/internal/ratelimit"
+	"github.com/fortuna91/ya_praktikum_final/internal/tracing"
 	"github.com/go-chi/chi/v5"
 )
 
+var BodyLimit int64 = 64 << 10
+var OrderBodyLimit int64 = 256
+var BatchBodyLimit int64 = 1 << 20
+
+// AccrualCallbackSecret enables POST /internal/accrual/callback for pushes signed with it.
+var AccrualCallbackSecret string
+
 func NewRouter() chi.Router {
+	jsonBody := chi.Middlewares{middleware.LimitBody(BodyLimit), middleware.RequireContentType("application/json")}
+	textBody := chi.Middlewares{middleware.LimitBody(OrderBodyLimit), middleware.RequireContentType("text/plain")}
+	batchBody := chi.Middlewares{middleware.LimitBody(BatchBodyLimit), middleware.RequireContentType("application/json", "text/plain")}
+
 	r := chi.NewRouter()
+	r.Use(tracing.Middleware, middleware.RequestID, middleware.AccessLog, metrics.Middleware, middleware.Authorization,
+		middleware.Decompress, middleware.Compress)
+	r.Handle("/metrics", metrics.Handler())
+	r.Get("/healthz", health.Healthz)
+	r.Get("/readyz", health.Readyz)
 	r.Route("/api/user", func(r chi.Router) {
-		r.Post("/register", handlers.Register)
-		r.Post("/login", handlers.Login)
-		r.Post("/orders", handlers.UploadOrder)
-		r.Get("/orders", handlers.GetOrders)
+		authLimit := middleware.RateLimit(ratelimit.GroupAuth)
+		r.With(authLimit).With(jsonBody...).Post("/register", handlers.Register)
+		r.With(authLimit).With(jsonBody...).Post("/login", handlers.Login)
+
+		ordersLimit := middleware.RateLimit(ratelimit.GroupOrders)
+		r.With(ordersLimit).With(textBody...).Post("/orders", handlers.UploadOrder)
+		r.With(ordersLimit).With(batchBody...).Post("/orders/batch", handlers.UploadOrders)
 
 		r.Route("/balance", func(r chi.Router) {
+			r.Use(middleware.RateLimit(ratelimit.GroupBalance))
 			r.Get("/", handlers.GetBalance)
-			r.Post("/withdraw", handlers.Withdraw)
+			r.With(jsonBody...).Post("/withdraw", handlers.Withdraw)
 			r.Get("/withdrawals", handlers.GetWithdrawals)
 		})
+		r.With(middleware.RateLimit(ratelimit.GroupBalance)).With(jsonBody...).Post("/promo/redeem", handlers.RedeemPromo)
+
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.RateLimit(ratelimit.GroupDefault))
+			r.Get("/orders", handlers.GetOrders)
+			r.Get("/orders/{number}", handlers.GetOrder)
+			r.Get("/events", handlers.Events)
+			r.Route("/webhooks", webhookRoutes(jsonBody))
+		})
+	})
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(middleware.Admin)
+		r.With(jsonBody...).Post("/promo", handlers.AddPromo)
+		r.Get("/promo", handlers.GetPromos)
+		r.With(jsonBody...).Post("/partners", handlers.AddPartner)
+		r.Post("/partners/{name}/key", handlers.RotatePartnerKey)
+		r.Get("/orders/failed", handlers.GetFailedOrders)
+		r.Post("/orders/{number}/requeue", handlers.RequeueOrder)
+		r.Get("/reconciliation/discrepancies", handlers.GetDiscrepancies)
+		r.Post("/reconciliation/run", handlers.RunReconciliation)
+		r.Route("/webhooks", webhookRoutes(jsonBody))
 	})
+	if AccrualCallbackSecret != "" {
+		r.With(jsonBody...).With(middleware.Signature(AccrualCallbackSecret)).
+			Post("/internal/accrual/callback", handlers.AccrualCallback)
+	}
 	return r
 }
+
+// webhookRoutes serves user webhooks under /api/user and partner webhooks under /api/admin.
+func webhookRoutes(jsonBody chi.Middlewares) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.With(jsonBody...).Post("/", handlers.AddWebhook)
+		r.Get("/", handlers.GetWebhooks)
+		r.Delete("/{id}", handlers.DeleteWebhook)
+		r.Get("/{id}/deliveries", handlers.GetWebhookDeliveries)
+		r.Post("/deliveries/{id}/redeliver", handlers.RedeliverWebhook)
+	}
+}
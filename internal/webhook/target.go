@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenTarget is returned for webhook URLs pointing into private networks. Deliveries
+// are sent from inside our network, so such URLs would let users reach internal services.
+var ErrForbiddenTarget = errors.New("webhook target must be a public address")
+
+// AllowPrivateTargets turns the check off, for local development only.
+var AllowPrivateTargets = false
+
+// sharedAddressSpace is 100.64.0.0/10 (RFC 6598), used by carrier-grade NAT and some clouds.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// IsPublicIP reports whether webhooks may be sent to ip.
+func IsPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if ip[0] == 0 || sharedAddressSpace.Contains(ip) {
+			return false
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// CheckURL validates a webhook URL at registration: it must be http or https and every
+// address its host resolves to must be public. Deliveries check the address again when
+// connecting, because DNS may change later.
+func CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("webhook URL must be an absolute http or https URL")
+	}
+	if AllowPrivateTargets {
+		return nil
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		if !IsPublicIP(ip) {
+			return ErrForbiddenTarget
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("couldn't resolve webhook host: %w", err)
+	}
+	for _, addr := range addrs {
+		if !IsPublicIP(addr.IP) {
+			return ErrForbiddenTarget
+		}
+	}
+	return nil
+}
+
+// checkDial refuses connections to non-public addresses. It runs after DNS resolution, for
+// redirects as well.
+func checkDial(_ string, address string, _ syscall.RawConn) error {
+	if AllowPrivateTargets {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+		return ErrForbiddenTarget
+	}
+	return nil
+}
+
+func newClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: checkDial}
+	return &http.Client{
+		Timeout: timeout,
+		// no proxy: it would connect to the target instead of us and skip the check
+		Transport: &http.Transport{DialContext: dialer.DialContext, MaxIdleConns: 10, IdleConnTimeout: 90 * time.Second,
+			TLSHandshakeTimeout: timeout},
+	}
+}
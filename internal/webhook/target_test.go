@@ -0,0 +1,68 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := IsPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("IsPublicIP(%s) = %t, want %t", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url string
+		err bool
+	}{
+		{"http://8.8.8.8/hook", false},
+		{"ftp://8.8.8.8/hook", true},
+		{"/hook", true},
+		{"http://127.0.0.1:8080/hook", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://[::1]/hook", true},
+		{"http://localhost/hook", true},
+	}
+	for _, tt := range tests {
+		if err := CheckURL(context.Background(), tt.url); (err != nil) != tt.err {
+			t.Errorf("CheckURL(%s) = %v, want error %t", tt.url, err, tt.err)
+		}
+	}
+}
+
+func TestClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, err := newClient(time.Second).Get(server.URL)
+	if !errors.Is(err, ErrForbiddenTarget) {
+		t.Fatalf("got %v, want %v", err, ErrForbiddenTarget)
+	}
+}
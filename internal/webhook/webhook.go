@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/fortuna91/ya_praktikum_final/internal/auth"
+	"github.com/fortuna91/ya_praktikum_final/internal/backoff"
+	dbmodule "github.com/fortuna91/ya_praktikum_final/internal/db"
+	"github.com/fortuna91/ya_praktikum_final/internal/entity"
+)
+
+const (
+	SignatureHeader = "X-Gophermart-Signature"
+	TimestampHeader = "X-Gophermart-Timestamp"
+	EventHeader     = "X-Gophermart-Event"
+	DeliveryHeader  = "X-Gophermart-Delivery"
+)
+
+var PollInterval = 2 * time.Second
+var BatchSize = 50
+var MaxAttempts = 8
+var BackoffBase = 10 * time.Second
+var BackoffMax = time.Hour
+var Timeout = 10 * time.Second
+
+var client = newClient(Timeout)
+
+// Sign returns the signature of the payload sent at timestamp. Receivers calculate it
+// with the webhook secret and compare with the X-Gophermart-Signature header.
+func Sign(secret string, timestamp string, payload string) string {
+	return "sha256=" + auth.CalcHash(secret, timestamp+"."+payload)
+}
+
+// Run sends pending webhook deliveries until ctx is done.
+func Run(ctx context.Context, db *dbmodule.DBStorage) {
+	client = newClient(Timeout)
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// the lease must outlive the sending, otherwise another instance takes the delivery again
+		deliveries, err := db.ClaimWebhookDeliveries(ctx, BatchSize, Timeout*time.Duration(BatchSize+1))
+		if err != nil {
+			log.Error().Msgf("Couldn't get webhook deliveries: %v", err)
+			continue
+		}
+		for _, delivery := range deliveries {
+			deliver(ctx, db, &delivery)
+		}
+	}
+}
+
+func deliver(ctx context.Context, db *dbmodule.DBStorage, delivery *entity.WebhookDelivery) {
+	responseCode, err := send(ctx, delivery)
+	if err == nil {
+		if errDB := db.CompleteWebhookDelivery(ctx, delivery.ID, responseCode); errDB != nil {
+			log.Error().Msgf("Couldn't complete webhook delivery %d: %v", delivery.ID, errDB)
+		}
+		return
+	}
+	log.Warn().Msgf("Webhook delivery %d, attempt %d failed: %v", delivery.ID, delivery.Attempts, err)
+	if errDB := db.FailWebhookDelivery(ctx, delivery.ID, responseCode, err.Error(), Backoff(delivery.Attempts), MaxAttempts); errDB != nil {
+		log.Error().Msgf("Couldn't save webhook delivery %d failure: %v", delivery.ID, errDB)
+	}
+}
+
+func send(ctx context.Context, delivery *entity.WebhookDelivery) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventHeader, delivery.Event)
+	request.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set(TimestampHeader, timestamp)
+	request.Header.Set(SignatureHeader, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected response code %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// Backoff returns the delay before the next attempt.
+func Backoff(attempt int) time.Duration {
+	return backoff.Exponential(BackoffBase, BackoffMax, attempt)
+}